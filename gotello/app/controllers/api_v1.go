@@ -0,0 +1,519 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/roy1210/Study/Go-drone/gotello/app/models"
+)
+
+const (
+	apiV1Prefix   = "/api/v1/"
+	minSpeed      = 1
+	maxSpeed      = 100
+	maxDurationMs = 10000
+	maxBodyBytes  = 1 << 20
+)
+
+// /api/v1/ のエラーはcodeとmessageを持つJsonで返す
+// fieldはどのパラメータが不正だったか
+type APIErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+}
+
+type APIErrorResult struct {
+	Error APIErrorDetail `json:"error"`
+	Code  int            `json:"code"`
+}
+
+func APIErrorResponse(w http.ResponseWriter, status int, code, message, field string) {
+	res := APIErrorResult{Error: APIErrorDetail{Code: code, Message: message, Field: field}, Code: status}
+	js, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// 入力が不正な時のエラー。decodeJSON, validateが返す
+type validationError struct {
+	field   string
+	message string
+}
+
+func (e *validationError) Error() string {
+	return e.message
+}
+
+func invalid(field, format string, args ...interface{}) error {
+	return &validationError{field: field, message: fmt.Sprintf(format, args...)}
+}
+
+// Jsonのbodyを厳しくチェックする。知らないフィールドや2つ目のJsonはエラー
+// bodyが空の場合は何もしない（パラメータの無いactionのため）
+func decodeJSON(r *http.Request, v interface{}) error {
+	if r.ContentLength == 0 {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return invalid("", "Content-Type must be application/json")
+	}
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return invalid("", "invalid JSON body: %s", err.Error())
+	}
+	if dec.More() {
+		return invalid("", "body must contain a single JSON object")
+	}
+	return nil
+}
+
+func validateSpeed(speed *int) error {
+	if speed != nil && (*speed < minSpeed || *speed > maxSpeed) {
+		return invalid("speed", "speed must be between %d and %d", minSpeed, maxSpeed)
+	}
+	return nil
+}
+
+// パスが見つからない時のエラー。/api/v1/profiles/ のようにパスにパラメータがある場合に使う
+type notFoundError struct {
+	path string
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("%s is not found", e.path)
+}
+
+// ログインしているroleではできない時のエラー。パスだけでは決まらない場合(他の人のprofile等)に使う
+type forbiddenError struct {
+	message string
+}
+
+func (e *forbiddenError) Error() string {
+	return e.message
+}
+
+// 今の状態では実行できないコマンドのエラー。409とこのcodeを返す
+var conflictCodes = map[error]string{
+	models.ErrEmergencyLatched:    "emergency_latched",
+	models.ErrPreempted:           "preempted",
+	models.ErrGeofence:            "geofence",
+	models.ErrMissionPadsDisabled: "mission_pads_disabled",
+	models.ErrAlreadyShaking:      "already_shaking",
+	models.ErrShakeNotFlying:      "not_flying",
+	errLeaseHeld:                  "lease_held",
+	errLeaseRequired:              "lease_required",
+	errNoLeaseRequest:             "no_lease_request",
+}
+
+// methodが違う場合は405, bodyが不正な場合は400, ドローンのエラーは500を返す
+func apiV1Handler(method string, fn func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return apiV1Methods("", map[string]func(r *http.Request) (interface{}, error){method: fn})
+}
+
+// 1つのパスで複数のmethodを受ける。commandは/metricsのラベル。空ならパスから作る
+func apiV1Methods(command string, handlers map[string]func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	methods := make([]string, 0, len(handlers))
+	for method := range handlers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	allow := strings.Join(methods, ", ")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		fn, ok := handlers[r.Method]
+		if !ok {
+			w.Header().Set("Allow", allow)
+			APIErrorResponse(w, http.StatusMethodNotAllowed, "method_not_allowed",
+				fmt.Sprintf("use %s for %s", allow, r.URL.Path), "")
+			return
+		}
+		// /metricsのgotello_commands_totalに入れる
+		label := command
+		if label == "" {
+			label = "v1/" + strings.TrimPrefix(r.URL.Path, apiV1Prefix)
+		}
+		result, err := fn(r)
+		if code, ok := conflictCodes[err]; ok {
+			commandCounts.inc(label, code)
+			APIErrorResponse(w, http.StatusConflict, code, err.Error(), "")
+			return
+		}
+		if err != nil {
+			switch e := err.(type) {
+			case *validationError:
+				commandCounts.inc(label, "invalid")
+				APIErrorResponse(w, http.StatusBadRequest, "invalid_argument", e.message, e.field)
+			case *notFoundError:
+				commandCounts.inc(label, "not_found")
+				APIErrorResponse(w, http.StatusNotFound, "not_found", e.Error(), "")
+			case *forbiddenError:
+				commandCounts.inc(label, "forbidden")
+				APIErrorResponse(w, http.StatusForbidden, "forbidden", e.Error(), "")
+			case *models.InvalidTransitionError:
+				// 今の飛行モードではできない(着陸中にpatrol等)
+				commandCounts.inc(label, "invalid_transition")
+				APIErrorResponse(w, http.StatusConflict, "invalid_transition", e.Error(), "")
+			default:
+				log.Printf("action=apiV1Handler path=%s err=%s", r.URL.Path, err.Error())
+				commandCounts.inc(label, "error")
+				APIErrorResponse(w, http.StatusInternalServerError, "drone_error", err.Error(), "")
+			}
+			return
+		}
+		commandCounts.inc(label, "ok")
+		if result == nil {
+			result = "OK"
+		}
+		APIResponse(w, result, http.StatusOK)
+	}
+}
+
+// 移動方向とドローンの操作
+func moveFuncs(drone *models.DroneManager) map[string]func(int) error {
+	return map[string]func(int) error{
+		"up":               drone.Up,
+		"down":             drone.Down,
+		"forward":          drone.Forward,
+		"backward":         drone.Backward,
+		"left":             drone.Left,
+		"right":            drone.Right,
+		"clockwise":        drone.Clockwise,
+		"counterClockwise": drone.CounterClockwise,
+	}
+}
+
+func flipFuncs(drone *models.DroneManager) map[string]func() error {
+	return map[string]func() error{
+		"front": drone.FrontFlip,
+		"back":  drone.BackFlip,
+		"left":  drone.LeftFlip,
+		"right": drone.RightFlip,
+	}
+}
+
+type moveRequest struct {
+	Direction  string `json:"direction"`
+	Speed      *int   `json:"speed"`
+	DurationMs int    `json:"durationMs"`
+}
+
+// durationMsが0の場合は止めるまで動き続ける
+// 指定した場合はその時間が経ったらHoverする。その前に別の移動のコマンドが来たらHoverしない
+func moveDrone(drone *models.DroneManager, req moveRequest) error {
+	move, ok := moveFuncs(drone)[req.Direction]
+	if !ok {
+		return invalid("direction", "unknown direction %q", req.Direction)
+	}
+	if err := validateSpeed(req.Speed); err != nil {
+		return err
+	}
+	if req.DurationMs < 0 || req.DurationMs > maxDurationMs {
+		return invalid("durationMs", "durationMs must be between 0 and %d", maxDurationMs)
+	}
+	speed := drone.Speed()
+	if req.Speed != nil {
+		speed = *req.Speed
+	}
+	if err := move(speed); err != nil {
+		return err
+	}
+	if req.DurationMs > 0 {
+		drone.HoverAfter(time.Duration(req.DurationMs) * time.Millisecond)
+	}
+	return nil
+}
+
+type flipRequest struct {
+	Direction string `json:"direction"`
+}
+
+func flipDrone(drone *models.DroneManager, req flipRequest) error {
+	flip, ok := flipFuncs(drone)[req.Direction]
+	if !ok {
+		return invalid("direction", "unknown direction %q", req.Direction)
+	}
+	return flip()
+}
+
+type takeOffRequest struct {
+	Throw bool `json:"throw"`
+}
+
+type speedRequest struct {
+	Speed *int `json:"speed"`
+}
+
+// patrol, tracking, hudのon/off
+type toggleRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+func decodeToggle(r *http.Request) (bool, error) {
+	var req toggleRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return false, err
+	}
+	if req.Enabled == nil {
+		return false, invalid("enabled", "enabled is required")
+	}
+	return *req.Enabled, nil
+}
+
+func apiV1TakeOff(r *http.Request) (interface{}, error) {
+	var req takeOffRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if req.Throw {
+		return nil, appContext.DroneManager.ThrowTakeOff()
+	}
+	return nil, appContext.DroneManager.TakeOff()
+}
+
+func apiV1Land(r *http.Request) (interface{}, error) {
+	return nil, appContext.DroneManager.Land()
+}
+
+// 離陸した場所に戻って着陸する。戻っている間のモードはreturnHome
+func apiV1ReturnHome(r *http.Request) (interface{}, error) {
+	return nil, appContext.DroneManager.ReturnHome()
+}
+
+func apiV1Hover(r *http.Request) (interface{}, error) {
+	appContext.DroneManager.Hover()
+	return nil, nil
+}
+
+func apiV1CeaseRotation(r *http.Request) (interface{}, error) {
+	appContext.DroneManager.CeaseRotation()
+	return nil, nil
+}
+
+func apiV1Move(r *http.Request) (interface{}, error) {
+	var req moveRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return nil, err
+	}
+	return nil, moveDrone(appContext.DroneManager, req)
+}
+
+func apiV1Flip(r *http.Request) (interface{}, error) {
+	var req flipRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return nil, err
+	}
+	return nil, flipDrone(appContext.DroneManager, req)
+}
+
+func apiV1Bounce(r *http.Request) (interface{}, error) {
+	return nil, appContext.DroneManager.Bounce()
+}
+
+func apiV1Speed(r *http.Request) (interface{}, error) {
+	var req speedRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if req.Speed == nil {
+		return nil, invalid("speed", "speed is required")
+	}
+	if err := validateSpeed(req.Speed); err != nil {
+		return nil, err
+	}
+	appContext.DroneManager.SetSpeed(*req.Speed)
+	return map[string]int{"speed": *req.Speed}, nil
+}
+
+func apiV1Patrol(r *http.Request) (interface{}, error) {
+	enabled, err := decodeToggle(r)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, appContext.DroneManager.StartPatrol()
+	}
+	appContext.DroneManager.StopPatrol()
+	return nil, nil
+}
+
+func apiV1Tracking(r *http.Request) (interface{}, error) {
+	enabled, err := decodeToggle(r)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, appContext.DroneManager.EnableFaceDetectTracking()
+	}
+	appContext.DroneManager.DisableFaceDetectTracking()
+	return nil, nil
+}
+
+func apiV1HUD(r *http.Request) (interface{}, error) {
+	enabled, err := decodeToggle(r)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		appContext.DroneManager.EnableMetricsHUD()
+	} else {
+		appContext.DroneManager.DisableMetricsHUD()
+	}
+	return nil, nil
+}
+
+func apiV1Snapshot(r *http.Request) (interface{}, error) {
+	appContext.DroneManager.TakeSnapShot()
+	return "/static/img/snapshots/snapshot.jpg", nil
+}
+
+// 送らなかった軸は0（スティックを離した状態）
+type rcRequest struct {
+	Roll     int `json:"roll"`
+	Pitch    int `json:"pitch"`
+	Throttle int `json:"throttle"`
+	Yaw      int `json:"yaw"`
+}
+
+// 高い頻度で呼ばれるので、ログは出さない
+func apiV1RC(r *http.Request) (interface{}, error) {
+	var req rcRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return nil, err
+	}
+	axes := []struct {
+		field string
+		value int
+	}{{"roll", req.Roll}, {"pitch", req.Pitch}, {"throttle", req.Throttle}, {"yaw", req.Yaw}}
+	for _, axis := range axes {
+		if axis.value < -maxSpeed || axis.value > maxSpeed {
+			return nil, invalid(axis.field, "%s must be between %d and %d", axis.field, -maxSpeed, maxSpeed)
+		}
+	}
+	return nil, appContext.DroneManager.SetSticks(models.Sticks(req))
+}
+
+// キューを通さずに、すぐにモーターを止める
+func apiV1Emergency(r *http.Request) (interface{}, error) {
+	log.Printf("action=apiV1Emergency remote=%s", r.RemoteAddr)
+	if err := appContext.DroneManager.Emergency(); err != nil {
+		return nil, err
+	}
+	return appContext.DroneManager.EmergencyState(), nil
+}
+
+func apiV1EmergencyState(r *http.Request) (interface{}, error) {
+	return appContext.DroneManager.EmergencyState(), nil
+}
+
+func apiV1Rearm(r *http.Request) (interface{}, error) {
+	if err := appContext.DroneManager.Rearm(); err != nil {
+		return nil, err
+	}
+	return appContext.DroneManager.EmergencyState(), nil
+}
+
+// mission padを基準にしたステップを順に飛ぶ。repeatが0ならDELETEするまで繰り返す
+func apiV1StartMission(r *http.Request) (interface{}, error) {
+	var mission models.Mission
+	if err := decodeJSON(r, &mission); err != nil {
+		return nil, err
+	}
+	if err := mission.Validate(); err != nil {
+		return nil, invalid("steps", "%s", err.Error())
+	}
+	if err := appContext.DroneManager.StartMission(mission); err != nil {
+		return nil, err
+	}
+	return appContext.DroneManager.MissionStatus(), nil
+}
+
+func apiV1StopMission(r *http.Request) (interface{}, error) {
+	appContext.DroneManager.StopMission()
+	return appContext.DroneManager.MissionStatus(), nil
+}
+
+func apiV1MissionStatus(r *http.Request) (interface{}, error) {
+	return appContext.DroneManager.MissionStatus(), nil
+}
+
+// 推定した位置とフェンスの設定
+func apiV1Geofence(r *http.Request) (interface{}, error) {
+	return appContext.DroneManager.Geofence(), nil
+}
+
+// コマンドキューで待っている数と、直近のコマンドの結果
+func apiV1Commands(r *http.Request) (interface{}, error) {
+	return appContext.DroneManager.CommandQueue(), nil
+}
+
+func apiV1Telemetry(r *http.Request) (interface{}, error) {
+	return appContext.DroneManager.Telemetry(), nil
+}
+
+// 登録されていないパスは構造化したエラーで404を返す
+func apiV1NotFound(w http.ResponseWriter, r *http.Request) {
+	APIErrorResponse(w, http.StatusNotFound, "not_found", fmt.Sprintf("%s is not found", r.URL.Path), "")
+}
+
+func registerAPIV1(mux *http.ServeMux) {
+	mux.HandleFunc(apiV1Prefix, apiV1NotFound)
+	mux.HandleFunc(apiV1Prefix+"takeoff", apiV1Handler(http.MethodPost, leased(apiV1TakeOff)))
+	mux.HandleFunc(apiV1Prefix+"land", apiV1Handler(http.MethodPost, leased(apiV1Land)))
+	mux.HandleFunc(apiV1Prefix+"hover", apiV1Handler(http.MethodPost, leased(apiV1Hover)))
+	mux.HandleFunc(apiV1Prefix+"return-home", apiV1Handler(http.MethodPost, leased(apiV1ReturnHome)))
+	mux.HandleFunc(apiV1Prefix+"cease-rotation", apiV1Handler(http.MethodPost, leased(apiV1CeaseRotation)))
+	mux.HandleFunc(apiV1Prefix+"move", apiV1Handler(http.MethodPost, leased(apiV1Move)))
+	mux.HandleFunc(apiV1Prefix+"flip", apiV1Handler(http.MethodPost, leased(apiV1Flip)))
+	mux.HandleFunc(apiV1Prefix+"bounce", apiV1Handler(http.MethodPost, leased(apiV1Bounce)))
+	mux.HandleFunc(apiV1Prefix+"speed", apiV1Handler(http.MethodPut, leased(apiV1Speed)))
+	mux.HandleFunc(apiV1Prefix+"patrol", apiV1Handler(http.MethodPut, leased(apiV1Patrol)))
+	mux.HandleFunc(apiV1Prefix+"tracking", apiV1Handler(http.MethodPut, leased(apiV1Tracking)))
+	mux.HandleFunc(apiV1Prefix+"hud", apiV1Handler(http.MethodPut, apiV1HUD))
+	mux.HandleFunc(apiV1Prefix+"snapshot", apiV1Handler(http.MethodPost, apiV1Snapshot))
+	mux.HandleFunc(apiV1Prefix+"rc", apiV1Handler(http.MethodPost, leased(apiV1RC)))
+	// gamepadとkeyboardはleaseが無くても緊急停止できるように、ハンドラーの中でleaseを確認する
+	mux.HandleFunc(apiV1Prefix+"gamepad", apiV1Handler(http.MethodPost, apiV1Gamepad))
+	mux.HandleFunc(apiV1Prefix+"keyboard", apiV1Handler(http.MethodPost, apiV1Keyboard))
+	mux.HandleFunc(apiV1Prefix+"profiles/", apiV1Methods("v1/profiles",
+		map[string]func(r *http.Request) (interface{}, error){
+			http.MethodGet: apiV1GetProfile,
+			http.MethodPut: apiV1PutProfile,
+		}))
+	mux.HandleFunc(apiV1Prefix+"emergency", apiV1Methods("", map[string]func(r *http.Request) (interface{}, error){
+		http.MethodGet:  apiV1EmergencyState,
+		http.MethodPost: apiV1Emergency,
+	}))
+	mux.HandleFunc(apiV1Prefix+"emergency/rearm", apiV1Handler(http.MethodPost, leased(apiV1Rearm)))
+	mux.HandleFunc(apiV1Prefix+"commands", apiV1Handler(http.MethodGet, apiV1Commands))
+	mux.HandleFunc(apiV1Prefix+"geofence", apiV1Handler(http.MethodGet, apiV1Geofence))
+	mux.HandleFunc(apiV1Prefix+"mission", apiV1Methods("", map[string]func(r *http.Request) (interface{}, error){
+		http.MethodGet:    apiV1MissionStatus,
+		http.MethodPut:    leased(apiV1StartMission),
+		http.MethodDelete: leased(apiV1StopMission),
+	}))
+	mux.HandleFunc(apiV1Prefix+"telemetry", apiV1Handler(http.MethodGet, apiV1Telemetry))
+	mux.HandleFunc(apiV1Prefix+"me", apiV1Handler(http.MethodGet, apiV1Me))
+	mux.HandleFunc(apiV1Prefix+"lease", apiV1Methods("", map[string]func(r *http.Request) (interface{}, error){
+		http.MethodGet:    apiV1LeaseStatus,
+		http.MethodPost:   apiV1AcquireLease,
+		http.MethodDelete: apiV1ReleaseLease,
+	}))
+	mux.HandleFunc(apiV1Prefix+"lease/request", apiV1Handler(http.MethodPost, apiV1RequestLease))
+	mux.HandleFunc(apiV1Prefix+"lease/handover", apiV1Handler(http.MethodPost, apiV1HandoverLease))
+	mux.HandleFunc(apiV1Prefix+"lease/override", apiV1Handler(http.MethodPost, apiV1OverrideLease))
+}
@@ -0,0 +1,291 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const sessionCookie = "gotello_session"
+
+// 大きいほど多くのことができる。pilotはviewerのこともできる
+type role int
+
+const (
+	roleNone role = iota
+	roleViewer
+	rolePilot
+	roleAdmin
+)
+
+var roleNames = map[string]role{"viewer": roleViewer, "pilot": rolePilot, "admin": roleAdmin}
+
+func (r role) String() string {
+	for name, v := range roleNames {
+		if v == r {
+			return name
+		}
+	}
+	return "none"
+}
+
+type account struct {
+	name string
+	role role
+	// usersはbcryptのhash, tokensはsha256
+	hash []byte
+}
+
+type session struct {
+	account account
+	expires time.Time
+}
+
+// config.iniの[users], [tokens]で認証して、ログインしたセッションはメモリに持つ。
+// 再起動したらログインし直す
+type authenticator struct {
+	enabled  bool
+	ttl      time.Duration
+	users    map[string]account
+	tokens   []account
+	mu       sync.Mutex
+	sessions map[string]session
+}
+
+// 値は role:hash。読めない行はログに出して使わない
+func parseAccount(name, value string) (account, bool) {
+	kv := strings.SplitN(value, ":", 2)
+	if len(kv) != 2 || roleNames[kv[0]] == roleNone || kv[1] == "" {
+		log.Printf("action=parseAccount name=%s err=value must be role:hash", name)
+		return account{}, false
+	}
+	return account{name: name, role: roleNames[kv[0]], hash: []byte(kv[1])}, true
+}
+
+var errNoAccounts = errors.New("auth is enabled but config.ini has no valid [users] or [tokens]: " +
+	"add a user with `go run ./tools/hashpassword` (or a token with -token), or set [auth] enable = false")
+
+// ユーザーがいない時もbcryptで比べるためのhash。ログインにかかる時間で、いる名前かどうかが分からないように
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("gotello"), bcrypt.DefaultCost)
+
+// 認証するのにログインできる人もtokenも無ければ、誰も使えないのでエラーにする
+func newAuthenticator(enabled bool, ttl time.Duration, users, tokens map[string]string) (*authenticator, error) {
+	a := &authenticator{enabled: enabled, ttl: ttl, users: map[string]account{}, sessions: map[string]session{}}
+	for name, value := range users {
+		if acct, ok := parseAccount(name, value); ok {
+			a.users[name] = acct
+		}
+	}
+	for name, value := range tokens {
+		acct, ok := parseAccount(name, value)
+		if !ok {
+			continue
+		}
+		hash, err := hex.DecodeString(string(acct.hash))
+		if err != nil || len(hash) != sha256.Size {
+			log.Printf("action=newAuthenticator token=%s err=hash must be a hex sha256", name)
+			continue
+		}
+		acct.hash = hash
+		a.tokens = append(a.tokens, acct)
+	}
+	if enabled && len(a.users) == 0 && len(a.tokens) == 0 {
+		return nil, errNoAccounts
+	}
+	return a, nil
+}
+
+// パスワードが合っていればセッションを作ってIDを返す
+func (a *authenticator) login(name, password string) (string, bool) {
+	acct, ok := a.users[name]
+	hash := dummyHash
+	if ok {
+		hash = acct.hash
+	}
+	// 名前が無い時も同じだけ時間をかける
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !ok {
+		return "", false
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("action=login err=%s", err.Error())
+		return "", false
+	}
+	id := hex.EncodeToString(buf)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	// 期限が切れたセッションはここで消す
+	for k, s := range a.sessions {
+		if now.After(s.expires) {
+			delete(a.sessions, k)
+		}
+	}
+	a.sessions[id] = session{account: acct, expires: now.Add(a.ttl)}
+	return id, true
+}
+
+func (a *authenticator) logout(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.sessions, id)
+}
+
+// セッションのCookieか、Authorization: Bearer のtokenで誰かを調べる
+func (a *authenticator) lookup(r *http.Request) (account, bool) {
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != r.Header.Get("Authorization") {
+		sum := sha256.Sum256([]byte(token))
+		for _, acct := range a.tokens {
+			if subtle.ConstantTimeCompare(sum[:], acct.hash) == 1 {
+				return acct, true
+			}
+		}
+		return account{}, false
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return account{}, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.sessions[cookie.Value]
+	if !ok || time.Now().After(s.expires) {
+		return account{}, false
+	}
+	return s.account, true
+}
+
+// パス毎に必要なrole。見るだけ(GET)はviewer, ドローンを動かすのと自分のprofileの保存はpilot,
+// config.iniに保存するもの、missionとrestream, leaseの強制的な取得はadmin。
+// 他の人のprofileはapiV1PutProfileでadminか確認する
+func requiredRole(r *http.Request) role {
+	path := r.URL.Path
+	switch {
+	case path == "/login" || path == "/logout":
+		return roleNone
+	// 写真とHLSのビデオ以外の静的ファイル(CSS, JS)はログインのページでも使う
+	case strings.HasPrefix(path, "/static/") &&
+		!strings.HasPrefix(path, "/static/img/snapshots/") && !strings.HasPrefix(path, "/static/hls/"):
+		return roleNone
+	// 古いAPIはGETのクエリでもコマンドを実行するので、メソッドに関係なくpilot
+	case strings.HasPrefix(path, "/api/command/"):
+		return rolePilot
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return roleViewer
+	// ビデオを見るためのWebRTCの接続
+	case path == "/api/webrtc/offer":
+		return roleViewer
+	case strings.HasPrefix(path, "/api/restream/"),
+		path == apiV1Prefix+"mission" && r.Method != http.MethodDelete,
+		path == apiV1Prefix+"lease/override":
+		return roleAdmin
+	}
+	return rolePilot
+}
+
+// 全部のリクエストの前に認証する。APIは401/403をJsonで返し、ページはログインに飛ばす
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		need := requiredRole(r)
+		if !a.enabled || need == roleNone {
+			next.ServeHTTP(w, r)
+			return
+		}
+		acct, ok := a.lookup(r)
+		page := !strings.HasPrefix(r.URL.Path, "/api/") && r.URL.Path != "/metrics" && !strings.HasPrefix(r.URL.Path, "/video/")
+		if !ok {
+			if page {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			APIErrorResponse(w, http.StatusUnauthorized, "unauthorized", "login or send a bearer token", "")
+			return
+		}
+		if acct.role < need {
+			log.Printf("action=auth user=%s role=%s need=%s method=%s path=%s", acct.name, acct.role, need, r.Method, r.URL.Path)
+			if page {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			APIErrorResponse(w, http.StatusForbidden, "forbidden", need.String()+" role is required", "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ログインした後に戻るページ。他のサイトに飛ばされないように、このサーバーのパスだけ
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func viewLoginHandler(w http.ResponseWriter, r *http.Request) {
+	next := safeNext(r.FormValue("next"))
+	status := http.StatusOK
+	message := ""
+	if r.Method == http.MethodPost {
+		if id, ok := appContext.Auth.login(r.FormValue("username"), r.FormValue("password")); ok {
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookie,
+				Value:    id,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+				Secure:   r.TLS != nil,
+				MaxAge:   int(appContext.Auth.ttl.Seconds()),
+			})
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		log.Printf("action=login user=%s remote=%s err=invalid username or password", r.FormValue("username"), r.RemoteAddr)
+		status = http.StatusUnauthorized
+		message = "Invalid username or password"
+	}
+
+	t, err := getTemplate("app/views/login.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	t.Execute(w, struct{ Next, Message, CSRFToken string }{next, message, csrfToken(r)})
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		APIResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		appContext.Auth.logout(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// ログインしている人とrole。ページで使えないボタンを隠すため
+// 認証しない設定なら誰でもadmin
+func apiV1Me(r *http.Request) (interface{}, error) {
+	acct, _ := appContext.Auth.lookup(r)
+	if !appContext.Auth.enabled {
+		acct.role = roleAdmin
+	}
+	return struct {
+		Name string `json:"name"`
+		Role string `json:"role"`
+	}{acct.name, acct.role.String()}, nil
+}
@@ -0,0 +1,192 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ログインしていなければ401, roleが足りなければ403
+func TestRequiredRoles(t *testing.T) {
+	handler := newTestHandler(t)
+	tests := []struct {
+		method, path, user string
+		status             int
+	}{
+		{http.MethodGet, "/api/v1/telemetry", "", http.StatusUnauthorized},
+		{http.MethodGet, "/api/v1/telemetry", "viewer", http.StatusOK},
+		{http.MethodPut, "/api/v1/speed", "viewer", http.StatusForbidden},
+		{http.MethodPut, "/api/v1/speed", "alice", http.StatusOK},
+		// 古いAPIはGETでもコマンドを実行するのでpilot
+		{http.MethodGet, "/api/command/?command=speed&speed=20", "viewer", http.StatusForbidden},
+		{http.MethodGet, "/api/command/?command=speed&speed=20", "alice", http.StatusOK},
+		{http.MethodPost, "/api/restream/stop?format=hls", "alice", http.StatusForbidden},
+		{http.MethodPost, "/api/restream/stop?format=hls", "admin", http.StatusConflict},
+		{http.MethodPost, "/api/v1/lease/override", "alice", http.StatusForbidden},
+		{http.MethodGet, "/metrics", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		body := ""
+		if tt.path == "/api/v1/speed" {
+			body = `{"speed":20}`
+		}
+		w := serve(handler, tt.method, tt.path, testTokens[tt.user], body)
+		if w.Code != tt.status {
+			t.Errorf("%s %s as %q = %d %s, want %d", tt.method, tt.path, tt.user, w.Code, w.Body, tt.status)
+			continue
+		}
+		var res APIErrorResult
+		json.Unmarshal(w.Body.Bytes(), &res)
+		switch {
+		case tt.status == http.StatusUnauthorized && res.Error.Code != "unauthorized",
+			tt.status == http.StatusForbidden && res.Error.Code != "forbidden":
+			t.Errorf("%s %s as %q code = %q", tt.method, tt.path, tt.user, res.Error.Code)
+		}
+	}
+}
+
+// ページはJsonではなくログインに飛ばす
+func TestPageRedirectsToLogin(t *testing.T) {
+	handler := newTestHandler(t)
+	w := serve(handler, http.MethodGet, "/controller/", "", "")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login?next=%2Fcontroller%2F" {
+		t.Fatalf("GET /controller/ = %d Location=%q, want 303 to the login page", w.Code, w.Header().Get("Location"))
+	}
+}
+
+var csrfField = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// ページのformのcsrf_tokenと、その時のCookie
+func pageCSRF(t *testing.T, w *http.Response, body string, cookies []*http.Cookie) (string, []*http.Cookie) {
+	t.Helper()
+	m := csrfField.FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("no csrf_token in the page: %s", body)
+	}
+	if c := findCookie(w.Cookies(), csrfCookie); c != nil {
+		cookies = append(cookies, c)
+	}
+	if findCookie(cookies, csrfCookie) == nil {
+		t.Fatal("no CSRF cookie")
+	}
+	return m[1], cookies
+}
+
+func TestLogin(t *testing.T) {
+	chdirRoot(t)
+	handler := newTestHandler(t)
+
+	w := serveForm(handler, http.MethodGet, "/login?next=/controller/", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /login = %d", w.Code)
+	}
+	token, cookies := pageCSRF(t, w.Result(), w.Body.String(), nil)
+	form := url.Values{"username": {"alice"}, "password": {testPassword}, "next": {"/controller/"}}
+
+	// formにトークンが無ければ403
+	if w := serveForm(handler, http.MethodPost, "/login", form, cookies); w.Code != http.StatusForbidden {
+		t.Fatalf("POST /login without csrf_token = %d, want 403", w.Code)
+	}
+
+	form.Set("csrf_token", token)
+	form.Set("password", "wrong")
+	if w := serveForm(handler, http.MethodPost, "/login", form, cookies); w.Code != http.StatusUnauthorized {
+		t.Fatalf("POST /login with a wrong password = %d, want 401", w.Code)
+	}
+
+	form.Set("password", testPassword)
+	w = serveForm(handler, http.MethodPost, "/login", form, cookies)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/controller/" {
+		t.Fatalf("POST /login = %d Location=%q, want 303 to /controller/", w.Code, w.Header().Get("Location"))
+	}
+	session := findCookie(w.Result().Cookies(), sessionCookie)
+	if session == nil || !session.HttpOnly {
+		t.Fatalf("session cookie = %+v, want an HttpOnly cookie", session)
+	}
+
+	// セッションのCookieでAPIを使える
+	w = serveForm(handler, http.MethodGet, "/api/v1/me", nil, []*http.Cookie{session})
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /api/v1/me with the session = %d %s", w.Code, w.Body)
+	}
+}
+
+func TestLoginUnknownUserTakesAsLong(t *testing.T) {
+	auth, err := newAuthenticator(true, time.Hour, map[string]string{"alice": "pilot:" + string(testPasswordHash)}, nil)
+	if err != nil {
+		t.Fatalf("newAuthenticator: %v", err)
+	}
+	start := time.Now()
+	bcrypt.CompareHashAndPassword(dummyHash, []byte("wrong"))
+	baseline := time.Since(start)
+
+	start = time.Now()
+	if _, ok := auth.login("nobody", "wrong"); ok {
+		t.Fatal("unknown user logged in")
+	}
+	// 名前が無くてもbcryptで比べているか。時間は揺れるので半分まで許す
+	if elapsed := time.Since(start); elapsed < baseline/2 {
+		t.Fatalf("unknown user took %s, bcrypt takes %s", elapsed, baseline)
+	}
+}
+
+func TestSafeNext(t *testing.T) {
+	tests := map[string]string{
+		"":                      "/",
+		"/controller/":          "/controller/",
+		"/api/v1/me?x=1":        "/api/v1/me?x=1",
+		"//evil.example":        "/",
+		"/\\evil.example":       "/",
+		"https://evil.example/": "/",
+		"controller":            "/",
+	}
+	for next, want := range tests {
+		if got := safeNext(next); got != want {
+			t.Errorf("safeNext(%q) = %q, want %q", next, got, want)
+		}
+	}
+}
+
+func TestNoAccounts(t *testing.T) {
+	if _, err := newAuthenticator(true, time.Hour, map[string]string{"bob": "pilot"}, nil); err != errNoAccounts {
+		t.Fatalf("err = %v, want errNoAccounts", err)
+	}
+	if _, err := newAuthenticator(false, time.Hour, nil, nil); err != nil {
+		t.Fatalf("auth disabled: err = %v", err)
+	}
+}
+
+// トップページのログアウトのformで、Cookieとformのトークンを送ってログアウトする
+func TestLogout(t *testing.T) {
+	chdirRoot(t)
+	handler := newTestHandler(t)
+
+	id, ok := appContext.Auth.login("alice", testPassword)
+	if !ok {
+		t.Fatal("login failed")
+	}
+	cookies := []*http.Cookie{{Name: sessionCookie, Value: id}}
+	w := serveForm(handler, http.MethodGet, "/", nil, cookies)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET / = %d", w.Code)
+	}
+	token, cookies := pageCSRF(t, w.Result(), w.Body.String(), cookies)
+
+	// トークンが違えばログアウトしない
+	if w := serveForm(handler, http.MethodPost, "/logout", url.Values{"csrf_token": {"wrong"}}, cookies); w.Code != http.StatusForbidden {
+		t.Fatalf("POST /logout with a wrong token = %d, want 403", w.Code)
+	}
+
+	w = serveForm(handler, http.MethodPost, "/logout", url.Values{"csrf_token": {token}}, cookies)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+		t.Fatalf("POST /logout = %d Location=%q, want 303 to /login", w.Code, w.Header().Get("Location"))
+	}
+	if w := serveForm(handler, http.MethodGet, "/api/v1/me", nil, cookies); w.Code != http.StatusUnauthorized {
+		t.Fatalf("GET /api/v1/me after logout = %d, want 401", w.Code)
+	}
+}
@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/roy1210/Study/Go-drone/gotello/app/models"
+)
+
+// gamepadのボタンに割り当てられるコマンド。名前は/api/command/と同じ
+// 動き続けるコマンド(up, forward等)はスティックで操作するので入れない
+func buttonCommands(drone *models.DroneManager) map[string]func() error {
+	return map[string]func() error{
+		"ceseRotation":        func() error { drone.CeaseRotation(); return nil },
+		"takeOff":             drone.TakeOff,
+		"takeOffLand":         func() error { return takeOffOrLand(drone) },
+		"throwTakeOff":        drone.ThrowTakeOff,
+		"land":                drone.Land,
+		"hover":               func() error { drone.Hover(); return nil },
+		"frontFlip":           drone.FrontFlip,
+		"backFlip":            drone.BackFlip,
+		"leftFlip":            drone.LeftFlip,
+		"rightFlip":           drone.RightFlip,
+		"bounce":              drone.Bounce,
+		"patrol":              drone.StartPatrol,
+		"stopPatrol":          func() error { drone.StopPatrol(); return nil },
+		"faceDetectTrack":     drone.EnableFaceDetectTracking,
+		"stopFaceDetectTrack": func() error { drone.DisableFaceDetectTracking(); return nil },
+		"snapshot":            func() error { drone.TakeSnapShot(); return nil },
+		"showMetrics":         func() error { drone.EnableMetricsHUD(); return nil },
+		"hideMetrics":         func() error { drone.DisableMetricsHUD(); return nil },
+		"emergency":           drone.Emergency,
+		"returnHome":          drone.ReturnHome,
+		"stopMission":         func() error { drone.StopMission(); return nil },
+	}
+}
+
+// 飛んでいれば着陸、飛んでいなければ離陸。1つのボタン(キー)で両方できるように
+func takeOffOrLand(drone *models.DroneManager) error {
+	if drone.Telemetry().Flying {
+		return drone.Land()
+	}
+	return drone.TakeOff()
+}
+
+func isButtonCommand(command string) bool {
+	_, ok := buttonCommands(appContext.DroneManager)[command]
+	return ok
+}
+
+// この時間入力が来なかったクライアントの前回の状態は消す
+const inputStateTTL = time.Minute
+
+// 入力を送ってきたクライアント。同じprofileを使う2人の押したボタンが混ざらないように、
+// ログインのセッション, Bearerのtoken, どちらも無ければIPアドレスで分ける
+func inputClient(r *http.Request) string {
+	if cookie, err := r.Cookie(sessionCookie); err == nil && cookie.Value != "" {
+		return "session:" + cookie.Value
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		return "auth:" + auth
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "addr:" + host
+}
+
+// 前回の入力のボタンの状態。押した瞬間だけコマンドを実行するため、クライアント毎に持つ
+type buttonState struct {
+	pressed []bool
+	at      time.Time
+}
+
+var gamepadButtons = struct {
+	sync.Mutex
+	clients map[string]buttonState
+}{clients: map[string]buttonState{}}
+
+// 今回押されたボタンの番号
+func pressedButtons(client string, buttons []bool) []int {
+	gamepadButtons.Lock()
+	defer gamepadButtons.Unlock()
+	now := time.Now()
+	for k, state := range gamepadButtons.clients {
+		if now.Sub(state.at) > inputStateTTL {
+			delete(gamepadButtons.clients, k)
+		}
+	}
+	last := gamepadButtons.clients[client].pressed
+	var pressed []int
+	for i, on := range buttons {
+		if on && (i >= len(last) || !last[i]) {
+			pressed = append(pressed, i)
+		}
+	}
+	gamepadButtons.clients[client] = buttonState{pressed: append(last[:0], buttons...), at: now}
+	return pressed
+}
+
+// leaseを持っていない時(leaseErrがnilでない時)は、緊急停止等のleaseの要らないコマンドだけ実行する
+func runInputCommand(drone *models.DroneManager, command string, leaseErr error) (bool, error) {
+	if leaseErr != nil && !leaseFreeCommands[command] {
+		return false, nil
+	}
+	if err := buttonCommands(drone)[command](); err != nil {
+		commandCounts.inc(command, "error")
+		return false, err
+	}
+	commandCounts.inc(command, "ok")
+	return true, nil
+}
+
+// ブラウザのGamepad APIの値をそのまま送る。axesは-1~1, buttonsは押されているか
+type gamepadRequest struct {
+	Profile string    `json:"profile"`
+	Axes    []float64 `json:"axes"`
+	Buttons []bool    `json:"buttons"`
+}
+
+// gamepadとkeyboardの結果。ドローンに送ったスティックと、実行したコマンド
+type inputResult struct {
+	Sticks   models.Sticks `json:"sticks"`
+	Commands []string      `json:"commands"`
+}
+
+// スティックはrcとしてドローンに送り、押したボタンのコマンドを実行する
+// controller.htmlから20Hzで呼ばれるので、ログはボタンを押した時だけ。
+// leaseを持っていなくても緊急停止はできるように、その時はスティックを送らずにleaseの要らないコマンドだけ実行する
+func apiV1Gamepad(r *http.Request) (interface{}, error) {
+	var req gamepadRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if req.Profile == "" {
+		req.Profile = accountProfile(r)
+	}
+	profile, err := gamepadProfile(req.Profile)
+	if err != nil {
+		return nil, err
+	}
+
+	drone := appContext.DroneManager
+	result := inputResult{Commands: []string{}}
+	leaseErr := appContext.Lease.check(r.Header.Get(leaseHeader))
+	if leaseErr == nil {
+		result.Sticks = profile.Sticks(req.Axes)
+		if err := drone.SetSticks(result.Sticks); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, button := range pressedButtons(inputClient(r), req.Buttons) {
+		command, ok := profile.Buttons[button]
+		if !ok {
+			continue
+		}
+		log.Printf("action=apiV1Gamepad profile=%s button=%d command=%s", req.Profile, button, command)
+		ran, err := runInputCommand(drone, command, leaseErr)
+		if err != nil {
+			return nil, err
+		}
+		if ran {
+			result.Commands = append(result.Commands, command)
+		}
+	}
+	if leaseErr != nil && len(result.Commands) == 0 {
+		return nil, leaseErr
+	}
+	return result, nil
+}
@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const maxHeldKeys = 16
+
+// 前回の入力で押されていたキー。押した瞬間だけコマンドを実行するため、クライアント毎に持つ
+type keyState struct {
+	held map[string]bool
+	at   time.Time
+}
+
+var keyboardKeys = struct {
+	sync.Mutex
+	clients map[string]keyState
+}{clients: map[string]keyState{}}
+
+// 今回新しく押されたキー
+func pressedKeys(client string, keys []string) []string {
+	keyboardKeys.Lock()
+	defer keyboardKeys.Unlock()
+	now := time.Now()
+	for k, state := range keyboardKeys.clients {
+		if now.Sub(state.at) > inputStateTTL {
+			delete(keyboardKeys.clients, k)
+		}
+	}
+	last := keyboardKeys.clients[client].held
+	held := make(map[string]bool, len(keys))
+	var pressed []string
+	for _, key := range keys {
+		if !last[key] && !held[key] {
+			pressed = append(pressed, key)
+		}
+		held[key] = true
+	}
+	keyboardKeys.clients[client] = keyState{held: held, at: now}
+	return pressed
+}
+
+// keysは今押しているキー(KeyboardEvent.code)の全部。
+// keydownとkeyupの度に送り、押している間は200ミリセカンド毎に送り続ける
+type keyboardRequest struct {
+	Profile string   `json:"profile"`
+	Keys    []string `json:"keys"`
+}
+
+// 移動のキーは押している間だけSpeedの速さでrcとして送る。離すと止まる
+// 移動以外のキーは押した時に1回だけコマンドを実行する。
+// leaseを持っていない時は移動のキーは無視して、緊急停止等のleaseの要らないコマンドだけ実行する
+func apiV1Keyboard(r *http.Request) (interface{}, error) {
+	var req keyboardRequest
+	if err := decodeJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if len(req.Keys) > maxHeldKeys {
+		return nil, invalid("keys", "keys must have at most %d items", maxHeldKeys)
+	}
+	if req.Profile == "" {
+		req.Profile = accountProfile(r)
+	}
+	profile, err := keyboardProfile(req.Profile)
+	if err != nil {
+		return nil, err
+	}
+
+	drone := appContext.DroneManager
+	result := inputResult{Commands: []string{}}
+	leaseErr := appContext.Lease.check(r.Header.Get(leaseHeader))
+	if leaseErr == nil {
+		result.Sticks = profile.Sticks(req.Keys, drone.Speed())
+		if err := drone.SetSticks(result.Sticks); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, key := range pressedKeys(inputClient(r), req.Keys) {
+		command, ok := profile.Command(key)
+		if !ok {
+			continue
+		}
+		log.Printf("action=apiV1Keyboard profile=%s key=%s command=%s", req.Profile, key, command)
+		ran, err := runInputCommand(drone, command, leaseErr)
+		if err != nil {
+			return nil, err
+		}
+		if ran {
+			result.Commands = append(result.Commands, command)
+		}
+	}
+	if leaseErr != nil && len(result.Commands) == 0 {
+		return nil, leaseErr
+	}
+	return result, nil
+}
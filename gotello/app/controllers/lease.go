@@ -0,0 +1,218 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 操縦権(lease)のIDを送るヘッダー
+const leaseHeader = "X-Pilot-Lease"
+
+var (
+	errLeaseHeld      = errors.New("another pilot holds the control lease")
+	errLeaseRequired  = errors.New("acquire the control lease before flying")
+	errNoLeaseRequest = errors.New("nobody has requested the control lease")
+)
+
+// GET /api/v1/lease。IDは自分が持っている(か頼んでいる)時だけ返す
+type leaseStatus struct {
+	Enabled     bool      `json:"enabled"`
+	Held        bool      `json:"held"`
+	Holder      string    `json:"holder,omitempty"`
+	ExpiresAt   time.Time `json:"expiresAt,omitempty"`
+	Yours       bool      `json:"yours"`
+	RequestedBy string    `json:"requestedBy,omitempty"`
+	ID          string    `json:"id,omitempty"`
+}
+
+// 1人だけが操縦できるようにする。他の人は見るだけで、動かすコマンドは409になる。
+// leaseはコマンドを送る度とrenewで延長し、timeoutの間何も来なければ外れる。
+// 操縦したい人はrequestして、持っている人がhandoverすると移る
+type pilotLease struct {
+	mu          sync.Mutex
+	enabled     bool
+	timeout     time.Duration
+	id          string
+	holder      string
+	expires     time.Time
+	requestID   string
+	requestedBy string
+}
+
+func newPilotLease(enabled bool, timeout time.Duration) *pilotLease {
+	return &pilotLease{enabled: enabled, timeout: timeout}
+}
+
+func newLeaseID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// 期限が切れていれば外す
+func (l *pilotLease) expireLocked(now time.Time) {
+	if l.id != "" && now.After(l.expires) {
+		log.Printf("action=lease holder=%s expired", l.holder)
+		l.id, l.holder = "", ""
+	}
+}
+
+func (l *pilotLease) statusLocked(id string) leaseStatus {
+	s := leaseStatus{Enabled: l.enabled, Held: l.id != "", Holder: l.holder, RequestedBy: l.requestedBy}
+	if s.Held {
+		s.ExpiresAt = l.expires
+	}
+	switch {
+	case id != "" && id == l.id:
+		s.Yours, s.ID = true, id
+	case id != "" && id == l.requestID:
+		s.ID = id
+	}
+	return s
+}
+
+func (l *pilotLease) status(id string) leaseStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expireLocked(time.Now())
+	return l.statusLocked(id)
+}
+
+// 誰も持っていなければ取る。自分が持っていれば延長する
+func (l *pilotLease) acquire(id, name string) (leaseStatus, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.expireLocked(now)
+	switch {
+	case l.id != "" && l.id == id:
+	case l.id != "":
+		return l.statusLocked(id), errLeaseHeld
+	default:
+		// 頼んでいた人が取ったら頼みを消す
+		if id == "" || id != l.requestID {
+			id = newLeaseID()
+		}
+		l.id, l.holder = id, name
+		l.requestID, l.requestedBy = "", ""
+		log.Printf("action=lease holder=%s acquired", name)
+	}
+	l.expires = now.Add(l.timeout)
+	return l.statusLocked(id), nil
+}
+
+// 持っている人だけ放せる
+func (l *pilotLease) release(id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expireLocked(time.Now())
+	if l.id == "" || l.id != id {
+		return errLeaseRequired
+	}
+	log.Printf("action=lease holder=%s released", l.holder)
+	l.id, l.holder = "", ""
+	return nil
+}
+
+// 操縦したいことを伝える。返ったIDを送ってGETすると、handoverされたかが分かる
+func (l *pilotLease) request(name string) leaseStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expireLocked(time.Now())
+	l.requestID, l.requestedBy = newLeaseID(), name
+	return l.statusLocked(l.requestID)
+}
+
+// 持っている人が、頼んでいる人に渡す
+func (l *pilotLease) handover(id string) (leaseStatus, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.expireLocked(now)
+	if l.id == "" || l.id != id {
+		return l.statusLocked(id), errLeaseRequired
+	}
+	if l.requestID == "" {
+		return l.statusLocked(id), errNoLeaseRequest
+	}
+	log.Printf("action=lease holder=%s handover to=%s", l.holder, l.requestedBy)
+	l.id, l.holder, l.expires = l.requestID, l.requestedBy, now.Add(l.timeout)
+	l.requestID, l.requestedBy = "", ""
+	return l.statusLocked(id), nil
+}
+
+// adminが強制的に取る
+func (l *pilotLease) override(name string) leaseStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	log.Printf("action=lease holder=%s override by=%s", l.holder, name)
+	l.id, l.holder, l.expires = newLeaseID(), name, time.Now().Add(l.timeout)
+	l.requestID, l.requestedBy = "", ""
+	return l.statusLocked(l.id)
+}
+
+// 動かすコマンドの前に呼ぶ。持っていれば延長する
+func (l *pilotLease) check(id string) error {
+	if !l.enabled {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.expireLocked(now)
+	if l.id == "" || l.id != id {
+		return errLeaseRequired
+	}
+	l.expires = now.Add(l.timeout)
+	return nil
+}
+
+// 誰がleaseを持つか。ログインしていればその名前、していなければIPアドレス
+func leaseName(r *http.Request) string {
+	if acct, ok := appContext.Auth.lookup(r); ok {
+		return acct.name
+	}
+	return r.RemoteAddr
+}
+
+// /api/v1/ の動かすコマンドに付ける。leaseを持っていなければ409
+func leased(fn func(r *http.Request) (interface{}, error)) func(r *http.Request) (interface{}, error) {
+	return func(r *http.Request) (interface{}, error) {
+		if err := appContext.Lease.check(r.Header.Get(leaseHeader)); err != nil {
+			return nil, err
+		}
+		return fn(r)
+	}
+}
+
+func apiV1LeaseStatus(r *http.Request) (interface{}, error) {
+	return appContext.Lease.status(r.Header.Get(leaseHeader)), nil
+}
+
+func apiV1AcquireLease(r *http.Request) (interface{}, error) {
+	return appContext.Lease.acquire(r.Header.Get(leaseHeader), leaseName(r))
+}
+
+func apiV1ReleaseLease(r *http.Request) (interface{}, error) {
+	if err := appContext.Lease.release(r.Header.Get(leaseHeader)); err != nil {
+		return nil, err
+	}
+	return appContext.Lease.status(""), nil
+}
+
+func apiV1RequestLease(r *http.Request) (interface{}, error) {
+	return appContext.Lease.request(leaseName(r)), nil
+}
+
+func apiV1HandoverLease(r *http.Request) (interface{}, error) {
+	return appContext.Lease.handover(r.Header.Get(leaseHeader))
+}
+
+func apiV1OverrideLease(r *http.Request) (interface{}, error) {
+	return appContext.Lease.override(leaseName(r)), nil
+}
@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/roy1210/Study/Go-drone/gotello/app/models"
+)
+
+// 認証しない時や、アカウントの名前がprofileの名前に使えない時のprofile
+const defaultProfile = "default"
+
+// profileはアカウントの名前で保存する。gamepadとkeyboardでprofileが指定されなければこれを使う
+func accountProfile(r *http.Request) string {
+	if acct, ok := appContext.Auth.lookup(r); ok && models.ValidProfileName(acct.name) {
+		return acct.name
+	}
+	return defaultProfile
+}
+
+// 自分のアカウントのprofileはpilotが保存できる。他の人とdefaultのprofileはadminだけ
+func checkProfileOwner(r *http.Request, name string) error {
+	if !appContext.Auth.enabled {
+		return nil
+	}
+	acct, _ := appContext.Auth.lookup(r)
+	if acct.role >= roleAdmin || acct.name == name {
+		return nil
+	}
+	return &forbiddenError{message: "admin role is required to change the profile of another account"}
+}
+
+func getProfile(name string) (models.Profile, error) {
+	p, err := appContext.Profiles.Get(name)
+	if err == models.ErrInvalidProfileName {
+		return p, invalid("profile", "%s", err.Error())
+	}
+	return p, err
+}
+
+// profileのgamepadの設定。保存されていなければXbox padのデフォルト
+func gamepadProfile(name string) (*models.GamepadProfile, error) {
+	p, err := getProfile(name)
+	if err != nil {
+		return nil, err
+	}
+	if p.Gamepad == nil {
+		return models.DefaultGamepadProfile(), nil
+	}
+	return p.Gamepad, nil
+}
+
+// profileのキーの割り当て。保存されていなければWASDのデフォルト
+func keyboardProfile(name string) (*models.KeyboardProfile, error) {
+	p, err := getProfile(name)
+	if err != nil {
+		return nil, err
+	}
+	if p.Keyboard == nil {
+		return models.DefaultKeyboardProfile(), nil
+	}
+	return p.Keyboard, nil
+}
+
+// /api/v1/profiles/<name>/<kind> のnameとkind(gamepad, keyboard)
+func profilePath(r *http.Request) (string, string, error) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, apiV1Prefix+"profiles/"), "/")
+	if len(parts) != 2 || (parts[1] != "gamepad" && parts[1] != "keyboard") {
+		return "", "", &notFoundError{path: r.URL.Path}
+	}
+	return parts[0], parts[1], nil
+}
+
+func apiV1GetProfile(r *http.Request) (interface{}, error) {
+	name, kind, err := profilePath(r)
+	if err != nil {
+		return nil, err
+	}
+	if kind == "keyboard" {
+		return keyboardProfile(name)
+	}
+	return gamepadProfile(name)
+}
+
+// 送られた方(gamepadかkeyboard)だけを書き換える
+func apiV1PutProfile(r *http.Request) (interface{}, error) {
+	name, kind, err := profilePath(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkProfileOwner(r, name); err != nil {
+		return nil, err
+	}
+
+	var update func(p *models.Profile)
+	var saved func(p models.Profile) interface{}
+	switch kind {
+	case "gamepad":
+		var gamepad models.GamepadProfile
+		if err := decodeJSON(r, &gamepad); err != nil {
+			return nil, err
+		}
+		if gamepad.Axes == nil && gamepad.Buttons == nil {
+			return nil, invalid("", "axes or buttons is required")
+		}
+		if err := gamepad.Validate(isButtonCommand); err != nil {
+			return nil, invalid("", "%s", err.Error())
+		}
+		update = func(p *models.Profile) { p.Gamepad = &gamepad }
+		saved = func(p models.Profile) interface{} { return p.Gamepad }
+	case "keyboard":
+		var keyboard models.KeyboardProfile
+		if err := decodeJSON(r, &keyboard); err != nil {
+			return nil, err
+		}
+		if keyboard.Keys == nil {
+			return nil, invalid("keys", "keys is required")
+		}
+		if err := keyboard.Validate(isButtonCommand); err != nil {
+			return nil, invalid("keys", "%s", err.Error())
+		}
+		update = func(p *models.Profile) { p.Keyboard = &keyboard }
+		saved = func(p models.Profile) interface{} { return p.Keyboard }
+	}
+
+	p, err := appContext.Profiles.Update(name, update)
+	if err == models.ErrInvalidProfileName {
+		return nil, invalid("profile", "%s", err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("action=apiV1PutProfile profile=%s kind=%s", name, kind)
+	return saved(p), nil
+}
@@ -0,0 +1,38 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testKeys = `{"keys":{"KeyI":"forward"}}`
+
+func TestPilotSavesOwnProfile(t *testing.T) {
+	handler := newTestHandler(t)
+
+	if w := serve(handler, http.MethodPut, "/api/v1/profiles/alice/keyboard", testTokens["alice"], testKeys); w.Code != http.StatusOK {
+		t.Fatalf("PUT own profile = %d %s, want 200", w.Code, w.Body)
+	}
+	w := serve(handler, http.MethodGet, "/api/v1/profiles/alice/keyboard", testTokens["viewer"], "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"KeyI":"forward"`) {
+		t.Fatalf("GET saved profile = %d %s, want the saved keys", w.Code, w.Body)
+	}
+}
+
+func TestOtherProfilesNeedAdmin(t *testing.T) {
+	handler := newTestHandler(t)
+
+	for _, name := range []string{"admin", "default"} {
+		w := serve(handler, http.MethodPut, "/api/v1/profiles/"+name+"/keyboard", testTokens["alice"], testKeys)
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), `"forbidden"`) {
+			t.Fatalf("pilot PUT %s profile = %d %s, want 403 forbidden", name, w.Code, w.Body)
+		}
+	}
+	if w := serve(handler, http.MethodPut, "/api/v1/profiles/alice/keyboard", testTokens["viewer"], testKeys); w.Code != http.StatusForbidden {
+		t.Fatalf("viewer PUT profile = %d, want 403", w.Code)
+	}
+	if w := serve(handler, http.MethodPut, "/api/v1/profiles/alice/keyboard", testTokens["admin"], testKeys); w.Code != http.StatusOK {
+		t.Fatalf("admin PUT another profile = %d %s, want 200", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/roy1210/Study/Go-drone/gotello/app/models"
+)
+
+// apiCommandHandlerで処理したcommandの回数。commandとresultのラベル毎に数える
+type commandCounter struct {
+	mu     sync.Mutex
+	counts map[[2]string]uint64
+}
+
+var commandCounts = &commandCounter{counts: map[[2]string]uint64{}}
+
+func (c *commandCounter) inc(command, result string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[[2]string{command, result}]++
+}
+
+// ラベルの順番を固定するためにsortする
+func (c *commandCounter) snapshot() ([][2]string, map[[2]string]uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([][2]string, 0, len(c.counts))
+	counts := make(map[[2]string]uint64, len(c.counts))
+	for k, v := range c.counts {
+		keys = append(keys, k)
+		counts[k] = v
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys, counts
+}
+
+// MJPEGのストリーミングを見ているクライアントの数
+var streamingClients int64
+
+func countClients(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&streamingClients, 1)
+		defer atomic.AddInt64(&streamingClients, -1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func writeMetric(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	writeMetric(w, name, "gauge", help)
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+func writeCounter(w io.Writer, name, help string, value uint64) {
+	writeMetric(w, name, "counter", help)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func writeHistograms(w io.Writer, name, help, label string, histograms map[string]models.HistogramSnapshot) {
+	writeMetric(w, name, "histogram", help)
+	keys := make([]string, 0, len(histograms))
+	for k := range histograms {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := histograms[k]
+		for i, le := range h.Buckets {
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=%q} %d\n", name, label, k, formatFloat(le), h.Cumulative[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", name, label, k, h.Count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %s\n", name, label, k, formatFloat(h.Sum))
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", name, label, k, h.Count)
+	}
+}
+
+// Prometheusのtext formatでドローンとサーバーの状態を返す
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	drone := appContext.DroneManager
+	telemetry := drone.Telemetry()
+	video := drone.Metrics.Snapshot()
+	webrtcPeers := 0
+	if drone.WebRTC != nil {
+		webrtcPeers = drone.WebRTC.Peers()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	buf := bufio.NewWriter(w)
+	defer buf.Flush()
+
+	writeGauge(buf, "tello_battery_percent", "Battery level reported by the drone.", float64(telemetry.Battery))
+	writeGauge(buf, "tello_height_meters", "Height reported by the drone.", float64(telemetry.Height)/10)
+	writeGauge(buf, "tello_wifi_strength", "Wifi signal strength reported by the drone.", float64(telemetry.WifiStrength))
+	writeGauge(buf, "tello_flying", "1 if the drone is flying.", boolToFloat(telemetry.Flying))
+	writeGauge(buf, "tello_patrolling", "1 if patrol mode is on.", boolToFloat(drone.IsPatrolling()))
+	writeGauge(buf, "tello_face_tracking", "1 if face detect tracking is on.", boolToFloat(drone.IsFaceDetectTracking()))
+	writeGauge(buf, "tello_emergency_latched", "1 if the emergency stop is latched.", boolToFloat(drone.EmergencyState().Latched))
+	writeGauge(buf, "gotello_command_queue_length", "Commands waiting for the command arbiter.", float64(drone.CommandQueue().Pending))
+	writeGauge(buf, "tello_speed", "Speed used for manual commands.", float64(drone.Speed()))
+
+	fence := drone.Geofence()
+	writeGauge(buf, "tello_geofence_breached", "1 if the estimated position is outside the geofence.", boolToFloat(fence.Breached))
+	writeGauge(buf, "tello_geofence_distance_meters", "Estimated horizontal distance from the take off point.", fence.Distance)
+
+	writeMetric(buf, "tello_flight_mode", "gauge", "1 for the current flight mode.")
+	mode := drone.FlightMode()
+	for _, m := range models.FlightModes {
+		fmt.Fprintf(buf, "tello_flight_mode{mode=%q} %s\n", m, formatFloat(boolToFloat(m == mode)))
+	}
+
+	writeMetric(buf, "gotello_connected_clients", "gauge", "Clients currently watching the video.")
+	fmt.Fprintf(buf, "gotello_connected_clients{stream=\"mjpeg\"} %d\n", atomic.LoadInt64(&streamingClients))
+	fmt.Fprintf(buf, "gotello_connected_clients{stream=\"webrtc\"} %d\n", webrtcPeers)
+
+	writeMetric(buf, "gotello_commands_total", "counter", "Commands handled by the command API.")
+	keys, counts := commandCounts.snapshot()
+	for _, k := range keys {
+		fmt.Fprintf(buf, "gotello_commands_total{command=%q,result=%q} %d\n", k[0], k[1], counts[k])
+	}
+
+	writeCounter(buf, "gotello_video_packets_total", "H.264 packets received from the drone.", video.PacketsIn)
+	writeCounter(buf, "gotello_video_bytes_total", "H.264 bytes received from the drone.", video.BytesIn)
+	writeCounter(buf, "gotello_video_frames_decoded_total", "Frames decoded.", video.FramesDecoded)
+	writeCounter(buf, "gotello_video_decode_errors_total", "Decoder read errors.", video.DecodeErrors)
+	writeCounter(buf, "gotello_video_frames_detected_total", "Frames run through face detection.", video.FramesDetected)
+	writeCounter(buf, "gotello_video_frames_published_total", "Frames published to the MJPEG stream.", video.FramesPublished)
+	writeGauge(buf, "gotello_video_publish_fps", "Frames per second published to the MJPEG stream.", video.PublishFPS)
+	writeHistograms(buf, "gotello_video_stage_seconds", "Time spent in each video pipeline stage.", "stage", video.Stages)
+}
@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// leaseを持っていなくても、作ったcommandの名前で/metricsのラベルが増えない
+func TestUnknownCommandDoesNotAddSeries(t *testing.T) {
+	handler := newTestHandler(t)
+	appContext.Lease = newPilotLease(true, time.Minute)
+
+	keys, _ := commandCounts.snapshot()
+	before := len(keys)
+	crafted := "x\"} 1\nfake_metric{a=\"b"
+	w := serve(handler, http.MethodGet, "/api/command/?command="+url.QueryEscape(crafted), testTokens["alice"], "")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown command = %d %s, want 404", w.Code, w.Body)
+	}
+	keys, counts := commandCounts.snapshot()
+	for _, k := range keys {
+		if k[0] == crafted {
+			t.Fatalf("unknown command was counted as %q", k)
+		}
+	}
+	if len(keys) > before+1 || counts[[2]string{"unknown", "not_found"}] == 0 {
+		t.Fatalf("series = %v, want only unknown/not_found to be added", keys)
+	}
+
+	// 知っているcommandはleaseが無ければ409で、commandの名前で数える
+	if w := serve(handler, http.MethodGet, "/api/command/?command=takeOff", testTokens["alice"], ""); w.Code != http.StatusConflict {
+		t.Fatalf("takeOff without the lease = %d %s, want 409", w.Code, w.Body)
+	}
+	if _, counts := commandCounts.snapshot(); counts[[2]string{"takeOff", "rejected"}] == 0 {
+		t.Fatal("takeOff without the lease was not counted as rejected")
+	}
+
+	w = serve(handler, http.MethodGet, "/metrics", testTokens["viewer"], "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "fake_metric") {
+		t.Fatalf("GET /metrics = %d, want no injected series:\n%s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,201 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	csrfCookie = "gotello_csrf"
+	csrfHeader = "X-CSRF-Token"
+	// ヘッダーを送れないformのためのフィールド
+	csrfFormField = "csrf_token"
+	// 自己署名の証明書の期限
+	selfSignedValidity = 365 * 24 * time.Hour
+)
+
+// 全部のレスポンスに付けるヘッダー。HSTSはHTTPSの時だけ
+func securityHeaders(csp string, hstsSeconds int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "same-origin")
+		if csp != "" {
+			h.Set("Content-Security-Policy", csp)
+		}
+		if r.TLS != nil && hstsSeconds > 0 {
+			h.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", hstsSeconds))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// double submit cookie。ページを開いた時にCookieにトークンを入れて、
+// 書き込むリクエスト(GET, HEAD以外)ではlayout.htmlのJSが同じ値をヘッダーで送ってきたかを確認する。
+// ログインとログアウトのformはヘッダーを送れないので、hiddenのcsrf_tokenで送る。
+// 他のサイトはCookieを読めないので、同じ値を送れない。
+// 古いAPI(/api/command/)はGETのクエリでもコマンドを実行するので、メソッドに関係なく確認する。
+// Bearerのtokenはブラウザが勝手に送らないので確認しない
+func csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(csrfCookie)
+		if err != nil || cookie.Value == "" {
+			cookie = &http.Cookie{
+				Name:     csrfCookie,
+				Value:    newCSRFToken(),
+				Path:     "/",
+				SameSite: http.SameSiteStrictMode,
+				Secure:   r.TLS != nil,
+			}
+			http.SetCookie(w, cookie)
+		}
+		if needsCSRFCheck(r) {
+			token := r.Header.Get(csrfHeader)
+			if token == "" {
+				token = r.PostFormValue(csrfFormField)
+			}
+			if err != nil || token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+				log.Printf("action=csrfProtect remote=%s method=%s path=%s err=invalid csrf token", r.RemoteAddr, r.Method, r.URL.Path)
+				if !strings.HasPrefix(r.URL.Path, "/api/") {
+					http.Error(w, "Invalid CSRF token, reload the page", http.StatusForbidden)
+					return
+				}
+				APIResponse(w, "Invalid CSRF token, reload the page", http.StatusForbidden)
+				return
+			}
+		}
+		// formに入れるため。Cookieを今作った時もこの値を使う
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfContextKey{}, cookie.Value)))
+	})
+}
+
+func needsCSRFCheck(r *http.Request) bool {
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return false
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/command/") {
+		return true
+	}
+	return r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions
+}
+
+type csrfContextKey struct{}
+
+// ページのformに入れるトークン。CSRFを確認しない設定なら空
+func csrfToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfContextKey{}).(string)
+	return token
+}
+
+func newCSRFToken() string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// 証明書と鍵が両方無ければ自己署名の証明書を作る。片方だけある時は上書きしないでエラーにする。
+// ブラウザには警告が出るので、ログのfingerprintと同じか確かめてから例外にする
+func ensureCertificate(certFile, keyFile string) error {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	switch {
+	case certErr == nil && keyErr == nil:
+		return nil
+	case !os.IsNotExist(certErr) || !os.IsNotExist(keyErr):
+		return fmt.Errorf("%s and %s must both exist or both be missing", certFile, keyFile)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "gotello"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	template.DNSNames, template.IPAddresses = certificateNames()
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return err
+		}
+	}
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(der)
+	log.Printf("action=ensureCertificate cert=%s names=%v ips=%v sha256=%s created self-signed certificate",
+		certFile, template.DNSNames, template.IPAddresses, hex.EncodeToString(sum[:]))
+	return nil
+}
+
+// localhostとこのPCの名前, IPアドレス。ドローンのWifiに繋いだ他のPCからも使えるように
+func certificateNames() ([]string, []net.IP) {
+	names := []string{"localhost"}
+	if host, err := os.Hostname(); err == nil && host != "localhost" {
+		names = append(names, host)
+	}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf("action=certificateNames err=%s", err.Error())
+		return names, ips
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return names, ips
+}
+
+func writePEM(file, blockType string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -8,6 +8,10 @@ import (
 	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
 
 	"github.com/roy1210/Study/Go-drone/gotello/app/models"
 	"github.com/roy1210/Study/Go-drone/gotello/config"
@@ -22,7 +26,8 @@ func viewIndexHandler(w http.ResponseWriter, r *http.Request) {
 	// t, _ := template.ParseFiles("app/views/index.html")
 	t, _ := getTemplate("app/views/index.html")
 
-	err := t.Execute(w, nil)
+	// ログアウトのformで送るCSRFのトークン
+	err := t.Execute(w, struct{ CSRFToken string }{csrfToken(r)})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -39,10 +44,23 @@ func viewControllerHandler(w http.ResponseWriter, r *http.Request) {
 
 var appContext struct {
 	DroneManager *models.DroneManager
+	Profiles     *models.ProfileStore
+	Auth         *authenticator
+	Lease        *pilotLease
+}
+
+// config.iniの[auth], [users], [tokens]から認証を作る
+func configAuthenticator() (*authenticator, error) {
+	return newAuthenticator(config.Config.AuthEnable, time.Duration(config.Config.AuthSessionHours)*time.Hour,
+		config.Config.AuthUsers, config.Config.AuthTokens)
 }
 
-func init() {
-	appContext.DroneManager = models.NewDroneManager()
+// ハンドラーが使うドローン, profile, 認証, leaseを用意する
+func setupAppContext(drone *models.DroneManager, auth *authenticator) {
+	appContext.DroneManager = drone
+	appContext.Profiles = models.NewProfileStore(config.Config.ProfilesDir)
+	appContext.Auth = auth
+	appContext.Lease = newPilotLease(config.Config.LeaseEnable, time.Duration(config.Config.LeaseTimeout)*time.Second)
 }
 
 func getSpeed(r *http.Request) int {
@@ -76,7 +94,7 @@ func APIResponse(w http.ResponseWriter, result interface{}, code int) {
 	w.Write(js)
 }
 
-var apiValidPath = regexp.MustCompile("^/api/(command|shake|video)")
+var apiValidPath = regexp.MustCompile("^/api/(command|shake|video|webrtc|restream|telemetry|state)")
 
 // 先にRegexでの判定を走らせたいから、このFuncを先に走って、後にapiCommandHandlerを走らせる。Wrapする形で。
 func apiMakeHandler(fn func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
@@ -93,83 +111,423 @@ func apiMakeHandler(fn func(w http.ResponseWriter, r *http.Request)) http.Handle
 	}
 }
 
+// apiCommandHandlerのcommand。/metricsのラベルになるので、switchに足したらここにも足す
+var legacyCommands = map[string]bool{
+	"ceseRotation": true, "takeOff": true, "land": true, "hover": true,
+	"up": true, "clockwise": true, "counterClockwise": true, "down": true,
+	"forward": true, "left": true, "right": true, "backward": true,
+	"frontFlip": true, "leftFlip": true, "rightFlip": true, "backFlip": true,
+	"patrol": true, "stopPatrol": true, "throwTakeOff": true, "bounce": true,
+	"faceDetectTrack": true, "stopFaceDetectTrack": true, "speed": true, "snapshot": true,
+	"showMetrics": true, "hideMetrics": true, "emergency": true, "rearm": true, "returnHome": true,
+}
+
+// leaseを持っていなくても実行できるコマンド。緊急停止は誰でもできる
+var leaseFreeCommands = map[string]bool{"emergency": true, "snapshot": true, "showMetrics": true, "hideMetrics": true}
+
 // frontからcommandの値を受け取る。
 // switch文を使いdroneにcommandの値を渡す
+// 互換性のために残している。新しいクライアントは /api/v1/ を使う
 func apiCommandHandler(w http.ResponseWriter, r *http.Request) {
 
 	command := r.FormValue("command")
 	log.Printf("action=apiCommandHandler command=%s", command)
+	// 任意の文字列がラベルにならないように、leaseを確認する前に知らないcommandはunknownで数える
+	if !legacyCommands[command] {
+		commandCounts.inc("unknown", "not_found")
+		APIResponse(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if !leaseFreeCommands[command] {
+		if err := appContext.Lease.check(r.Header.Get(leaseHeader)); err != nil {
+			commandCounts.inc(command, "rejected")
+			APIResponse(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
 
 	drone := appContext.DroneManager
+	var err error
 	switch command {
 	case "ceseRotation":
 		drone.CeaseRotation()
 	case "takeOff":
-		drone.TakeOff()
+		err = drone.TakeOff()
 	case "land":
-		drone.Land()
+		err = drone.Land()
 	case "hover":
 		drone.Hover()
 	case "up":
-		drone.Up(drone.Speed)
+		err = moveDrone(drone, moveRequest{Direction: command})
 	case "clockwise":
-		drone.Clockwise(drone.Speed)
+		err = moveDrone(drone, moveRequest{Direction: command})
 	case "counterClockwise":
-		drone.CounterClockwise(drone.Speed)
+		err = moveDrone(drone, moveRequest{Direction: command})
 	case "down":
-		drone.Down(drone.Speed)
+		err = moveDrone(drone, moveRequest{Direction: command})
 	case "forward":
-		drone.Forward(drone.Speed)
+		err = moveDrone(drone, moveRequest{Direction: command})
 	case "left":
-		drone.Left(drone.Speed)
+		err = moveDrone(drone, moveRequest{Direction: command})
 	case "right":
-		drone.Right(drone.Speed)
+		err = moveDrone(drone, moveRequest{Direction: command})
 	case "backward":
-		drone.Backward(drone.Speed)
+		err = moveDrone(drone, moveRequest{Direction: command})
 	case "frontFlip":
-		drone.FrontFlip()
+		err = flipDrone(drone, flipRequest{Direction: "front"})
 	case "leftFlip":
-		drone.LeftFlip()
+		err = flipDrone(drone, flipRequest{Direction: "left"})
 	case "rightFlip":
-		drone.RightFlip()
+		err = flipDrone(drone, flipRequest{Direction: "right"})
 	case "backFlip":
-		drone.BackFlip()
+		err = flipDrone(drone, flipRequest{Direction: "back"})
 	case "patrol":
-		drone.StartPatrol()
+		err = drone.StartPatrol()
 	case "stopPatrol":
 		drone.StopPatrol()
 	case "throwTakeOff":
-		drone.ThrowTakeOff()
+		err = drone.ThrowTakeOff()
 	case "bounce":
-		drone.Bounce()
+		err = drone.Bounce()
 	case "faceDetectTrack":
-		drone.EnableFaceDetectTracking()
+		err = drone.EnableFaceDetectTracking()
 	case "stopFaceDetectTrack":
 		drone.DisableFaceDetectTracking()
 	case "speed":
-		drone.Speed = getSpeed(r)
+		drone.SetSpeed(getSpeed(r))
 	case "snapshot":
 		drone.TakeSnapShot()
+	case "showMetrics":
+		drone.EnableMetricsHUD()
+	case "hideMetrics":
+		drone.DisableMetricsHUD()
+	case "emergency":
+		err = drone.Emergency()
+	case "rearm":
+		err = drone.Rearm()
+	case "returnHome":
+		err = drone.ReturnHome()
+	}
+
+	if _, ok := err.(*models.InvalidTransitionError); ok || conflictCodes[err] != "" {
+		commandCounts.inc(command, "rejected")
+		APIResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("action=apiCommandHandler command=%s err=%s", command, err.Error())
+		commandCounts.inc(command, "error")
+		APIResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	commandCounts.inc(command, "ok")
+	APIResponse(w, "OK", http.StatusOK)
+}
+
+// フォームの整数の値。空ならdefaultValue, 範囲外やエラーの場合はfalseを返す
+func getIntInRange(r *http.Request, key string, defaultValue, min, max int) (int, bool) {
+	str := r.FormValue(key)
+	if str == "" {
+		return defaultValue, true
+	}
+	value, err := strconv.Atoi(str)
+	if err != nil || value < min || value > max {
+		return 0, false
+	}
+	return value, true
+}
+
+// 左右に揺れる。amplitude: スピード(1-100), count: 往復の回数(1-10), interval: 片道のミリ秒(100-3000)
+func apiShakeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		APIResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	amplitude, ok := getIntInRange(r, "amplitude", 30, 1, 100)
+	if !ok {
+		APIResponse(w, "amplitude must be between 1 and 100", http.StatusBadRequest)
+		return
+	}
+	count, ok := getIntInRange(r, "count", 3, 1, 10)
+	if !ok {
+		APIResponse(w, "count must be between 1 and 10", http.StatusBadRequest)
+		return
+	}
+	interval, ok := getIntInRange(r, "interval", 500, 100, 3000)
+	if !ok {
+		APIResponse(w, "interval must be between 100 and 3000", http.StatusBadRequest)
+		return
+	}
+	log.Printf("action=apiShakeHandler amplitude=%d count=%d interval=%d", amplitude, count, interval)
+	if err := appContext.Lease.check(r.Header.Get(leaseHeader)); err != nil {
+		APIResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
+	// 揺れ始められなかった時(緊急停止中, 飛んでいない, 実行中, 取り消された)は409
+	err := appContext.DroneManager.Shake(amplitude, count, time.Duration(interval)*time.Millisecond)
+	if _, ok := conflictCodes[err]; ok {
+		APIResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		APIResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	APIResponse(w, "OK", http.StatusOK)
+}
+
+// ビデオの設定。GETで今の設定を返す。
+// POSTでstreaming(true/false), bitrate(auto, 1M, 1.5M, 2M, 3M, 4M), exposure(0-2), mode(narrow/wide)の
+// 指定されたものだけを変更して、変更後の設定を返す。
+func apiVideoHandler(w http.ResponseWriter, r *http.Request) {
+	drone := appContext.DroneManager
+	if r.Method == http.MethodGet {
+		APIResponse(w, drone.VideoSettings(), http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		APIResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if streaming := r.FormValue("streaming"); streaming != "" {
+		on, err := strconv.ParseBool(streaming)
+		if err != nil {
+			APIResponse(w, "streaming must be true or false", http.StatusBadRequest)
+			return
+		}
+		if on {
+			err = drone.StartVideoStream()
+		} else {
+			drone.StopVideoStream()
+		}
+		if err != nil {
+			APIResponse(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if bitrate := r.FormValue("bitrate"); bitrate != "" {
+		if err := drone.SetBitrate(bitrate); err != nil {
+			apiVideoError(w, err)
+			return
+		}
+	}
+	if r.FormValue("exposure") != "" {
+		exposure, err := strconv.Atoi(r.FormValue("exposure"))
+		if err != nil {
+			APIResponse(w, models.ErrInvalidExposure.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := drone.SetExposureLevel(exposure); err != nil {
+			apiVideoError(w, err)
+			return
+		}
+	}
+	if mode := r.FormValue("mode"); mode != "" {
+		if err := drone.SetVideoMode(mode); err != nil {
+			apiVideoError(w, err)
+			return
+		}
+	}
+	log.Printf("action=apiVideoHandler settings=%+v", drone.VideoSettings())
+	APIResponse(w, drone.VideoSettings(), http.StatusOK)
+}
+
+func apiVideoError(w http.ResponseWriter, err error) {
+	switch err {
+	case models.ErrUnknownBitrate, models.ErrInvalidExposure, models.ErrUnknownVideoMode:
+		APIResponse(w, err.Error(), http.StatusBadRequest)
+	default:
+		APIResponse(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ブラウザからSDP offerをJsonで受け取り、answerを返す。
+// MJPEGより遅延が少ないので、controller.htmlでの手動操縦用。
+func apiWebRTCOfferHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		APIResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	drone := appContext.DroneManager
+	if drone.WebRTC == nil {
+		APIResponse(w, "WebRTC is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	var offer webrtc.SessionDescription
+	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
+		APIResponse(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	answer, err := drone.WebRTC.Answer(offer)
+	if err != nil {
+		log.Printf("action=apiWebRTCOfferHandler err=%s", err.Error())
+		APIResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	APIResponse(w, answer, http.StatusOK)
+}
+
+// 再配信の解像度の上限。ffmpegにそのまま渡すので、大きすぎる値で重くならないように
+const (
+	maxRestreamWidth  = 1920
+	maxRestreamHeight = 1080
+)
+
+// 再配信の幅か高さ。空なら0(configの解像度)。libx264は奇数のサイズを扱えないので偶数だけ
+func getRestreamSize(r *http.Request, key string, max int) (int, bool) {
+	size, ok := getIntInRange(r, key, 0, 2, max)
+	if !ok || size%2 != 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// HLS, RTSPへの再配信の開始・停止。
+// format: hls or rtsp, width, heightは任意。無ければconfigの解像度
+func apiRestreamHandler(w http.ResponseWriter, r *http.Request) {
+	restream := appContext.DroneManager.Restream
+	action := strings.TrimPrefix(r.URL.Path, "/api/restream/")
+	if action == "" {
+		APIResponse(w, restream.Status(), http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		APIResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	format := r.FormValue("format")
+	log.Printf("action=apiRestreamHandler restream=%s format=%s", action, format)
+	var err error
+	switch action {
+	case "start":
+		width, ok := getRestreamSize(r, "width", maxRestreamWidth)
+		if !ok {
+			APIResponse(w, fmt.Sprintf("width must be an even number between 2 and %d", maxRestreamWidth), http.StatusBadRequest)
+			return
+		}
+		height, ok := getRestreamSize(r, "height", maxRestreamHeight)
+		if !ok {
+			APIResponse(w, fmt.Sprintf("height must be an even number between 2 and %d", maxRestreamHeight), http.StatusBadRequest)
+			return
+		}
+		err = restream.Start(format, width, height)
+	case "stop":
+		err = restream.Stop(format)
 	default:
 		APIResponse(w, "Not found", http.StatusNotFound)
 		return
 	}
 
+	switch err {
+	case nil:
+	case models.ErrUnknownRestreamFormat, models.ErrNoRTSPURL:
+		APIResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	case models.ErrRestreamRunning, models.ErrRestreamNotRunning:
+		APIResponse(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		APIResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if action == "start" && format == models.RestreamHLS {
+		APIResponse(w, restream.HLSPlaylistURL(), http.StatusOK)
+		return
+	}
 	APIResponse(w, "OK", http.StatusOK)
 }
 
+// ffmpegのデコーダーの状態(fps, 再起動回数, 最後のエラー)を返す
+func apiVideoHealthHandler(w http.ResponseWriter, r *http.Request) {
+	APIResponse(w, appContext.DroneManager.DecoderHealth(), http.StatusOK)
+}
+
+// ビデオの各段階の回数と処理時間のヒストグラムを返す
+func apiVideoMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	APIResponse(w, appContext.DroneManager.Metrics.Snapshot(), http.StatusOK)
+}
+
+// FlightData, WifiDataの最新値を返す
+func apiTelemetryHandler(w http.ResponseWriter, r *http.Request) {
+	APIResponse(w, appContext.DroneManager.Telemetry(), http.StatusOK)
+}
+
+// 今の飛行モードと、最近のモードの変化
+func apiStateHandler(w http.ResponseWriter, r *http.Request) {
+	APIResponse(w, appContext.DroneManager.FlightState(), http.StatusOK)
+}
+
 // 実際に返ってきたlog： 2019/05/09 17:03:26 webserver.go:78: action=apiCommandHandler command=ceaseRoatation
 
-func StartWebServer() error {
-	http.HandleFunc("/", viewIndexHandler)
-	http.HandleFunc("/controller/", viewControllerHandler)
-	http.HandleFunc("/api/command/", apiMakeHandler(apiCommandHandler))
-	http.Handle("/video/streaming", appContext.DroneManager.Stream)
+// 全部のパスを登録して、ログインとCSRF, セキュリティのヘッダーで包んだハンドラー。
+// StartWebServerはドローンに繋いだDroneManagerを、テストは偽物のDriverのDroneManagerを渡す
+func NewHandler(drone *models.DroneManager) (http.Handler, error) {
+	auth, err := configAuthenticator()
+	if err != nil {
+		return nil, err
+	}
+	return newHandler(drone, auth), nil
+}
+
+func newHandler(drone *models.DroneManager, auth *authenticator) http.Handler {
+	setupAppContext(drone, auth)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", viewIndexHandler)
+	mux.HandleFunc("/controller/", viewControllerHandler)
+	mux.HandleFunc("/login", viewLoginHandler)
+	mux.HandleFunc("/logout", logoutHandler)
+	mux.HandleFunc("/api/command/", apiMakeHandler(apiCommandHandler))
+	registerAPIV1(mux)
+	mux.HandleFunc("/api/webrtc/offer", apiMakeHandler(apiWebRTCOfferHandler))
+	mux.HandleFunc("/api/restream/", apiMakeHandler(apiRestreamHandler))
+	mux.HandleFunc("/api/shake", apiMakeHandler(apiShakeHandler))
+	mux.HandleFunc("/api/video", apiMakeHandler(apiVideoHandler))
+	mux.HandleFunc("/api/video/health", apiMakeHandler(apiVideoHealthHandler))
+	mux.HandleFunc("/api/video/metrics", apiMakeHandler(apiVideoMetricsHandler))
+	mux.HandleFunc("/api/telemetry", apiMakeHandler(apiTelemetryHandler))
+	mux.HandleFunc("/api/state", apiMakeHandler(apiStateHandler))
+	mux.Handle("/video/streaming", countClients(appContext.DroneManager.Stream))
+	// Prometheusから取りに来る
+	mux.HandleFunc("/metrics", metricsHandler)
+	// 他のチーム向けのAPIの仕様書
+	mux.HandleFunc("/api/openapi.yaml", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "api/openapi.yaml")
+	})
 
 	// staticのサーバー立ち上げ。
 	// Handlerではなく、既にフォルダとして静的なサイトの準備ができたものに対し、フォルダを読み込んでサーバーからアクセス出来るようにする。CSSやImgの格納場所
 	// http.StripPrefix("/static/" : staticがURLの先頭に来たときに"static"フォルダから読む。
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
-	return http.ListenAndServe(fmt.Sprintf("%s:%d", config.Config.Address, config.Config.Port), nil)
+	// 全部のハンドラーの前にログインとroleを確認してから、CSRFを確認する
+	var handler http.Handler = mux
+	if config.Config.CSRFEnable {
+		handler = csrfProtect(handler)
+	}
+	handler = appContext.Auth.middleware(handler)
+	if config.Config.SecurityHeaders {
+		handler = securityHeaders(config.Config.CSP, config.Config.HSTSSeconds, handler)
+	}
+	return handler
+}
+
+// ログインできる人がいない等、認証の設定がおかしければドローンに繋ぐ前にエラーを返す
+func StartWebServer() error {
+	auth, err := configAuthenticator()
+	if err != nil {
+		return err
+	}
+	handler := newHandler(models.NewDroneManager(), auth)
+	addr := fmt.Sprintf("%s:%d", config.Config.Address, config.Config.Port)
+	if !config.Config.TLSEnable {
+		return http.ListenAndServe(addr, handler)
+	}
+	if err := ensureCertificate(config.Config.TLSCertFile, config.Config.TLSKeyFile); err != nil {
+		return err
+	}
+	return http.ListenAndServeTLS(addr, config.Config.TLSCertFile, config.Config.TLSKeyFile, handler)
 }
@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/roy1210/Study/Go-drone/gotello/app/models"
+	"github.com/roy1210/Study/Go-drone/gotello/config"
+)
+
+// ドローンの代わり。テストで使わないメソッドは埋め込んだnilのDriverで、呼ばれたらpanicする
+type fakeDriver struct {
+	models.Driver
+}
+
+// roleとtokenの名前を同じにする。pilotはaliceで、aliceのprofileを保存できる
+var testTokens = map[string]string{
+	"admin":  "admin-token",
+	"alice":  "pilot-token",
+	"viewer": "viewer-token",
+}
+
+var testRoles = map[string]string{"admin": "admin", "alice": "pilot", "viewer": "viewer"}
+
+// ログインできるのはalice(pilot)だけ。テストを速くするためにbcryptのcostは最小にする
+const testPassword = "alice-password"
+
+var testPasswordHash, _ = bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// 本物のハンドラーを偽物のDriverで動かす。認証はconfig.iniに関係なく有効にする
+func newTestHandler(t *testing.T) http.Handler {
+	t.Helper()
+	config.Config.ProfilesDir = t.TempDir()
+	config.Config.LeaseEnable = false
+	config.Config.CSRFEnable = true
+
+	tokens := map[string]string{}
+	for name, token := range testTokens {
+		tokens[name] = testRoles[name] + ":" + sha256Hex(token)
+	}
+	users := map[string]string{"alice": "pilot:" + string(testPasswordHash)}
+	auth, err := newAuthenticator(true, time.Hour, users, tokens)
+	if err != nil {
+		t.Fatalf("newAuthenticator: %v", err)
+	}
+	return newHandler(models.NewDroneManagerWithDriver(&fakeDriver{}), auth)
+}
+
+// tokenが空ならAuthorizationを付けない
+func serve(handler http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// ログインのformのように、formとCookieを付けて送る。ページを描画するテストはchdirRootしておく
+func serveForm(handler http.Handler, method, path string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// テンプレートはapp/views/からの相対パスなので、gotelloのフォルダで実行する。
+// テストが終わったらパッケージのフォルダに戻す
+func chdirRoot(t *testing.T) {
+	t.Helper()
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd: %v", err)
+	}
+	if err := os.Chdir("../.."); err != nil {
+		t.Fatalf("Chdir: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+}
+
+func findCookie(cookies []*http.Cookie, name string) *http.Cookie {
+	for _, c := range cookies {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// コマンドの優先度。大きいほど優先する
+type CommandPriority int
+
+const (
+	PriorityAutonomous CommandPriority = iota
+	PriorityManual
+	PriorityGeofence
+	PriorityLand
+	PriorityEmergency
+)
+
+func (p CommandPriority) String() string {
+	switch p {
+	case PriorityAutonomous:
+		return "autonomous"
+	case PriorityManual:
+		return "manual"
+	case PriorityGeofence:
+		return "geofence"
+	case PriorityLand:
+		return "land"
+	case PriorityEmergency:
+		return "emergency"
+	}
+	return "unknown"
+}
+
+const (
+	// 手動の操作の後、この時間は自動(patrol, tracking)のコマンドを受け付けない。
+	// trackingがすぐにパイロットの操作を上書きしないように
+	autonomyHold = 2 * time.Second
+	// GET /api/v1/commands で返す直近のコマンドの数
+	commandHistorySize = 50
+)
+
+var ErrPreempted = errors.New("command was preempted by a higher priority command")
+
+// 実行したコマンドの結果。statusは ok, error, preempted
+type CommandResult struct {
+	Name     string        `json:"name"`
+	Priority string        `json:"priority"`
+	Status   string        `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	QueuedAt time.Time     `json:"queuedAt"`
+	Wait     time.Duration `json:"waitNs"`
+	Duration time.Duration `json:"durationNs"`
+}
+
+type droneCommand struct {
+	name     string
+	priority CommandPriority
+	fn       func() error
+	queuedAt time.Time
+	done     chan error
+}
+
+// HTTP, patrol, trackingからのDriverの呼び出しを1つのGoroutineで順番に実行する。
+// 高い優先度のコマンドが来たら、待っている低い優先度のコマンドはErrPreemptedで終わらせる
+type commandArbiter struct {
+	mu        sync.Mutex
+	pending   []*droneCommand
+	wake      chan struct{}
+	holdUntil time.Time
+	history   []CommandResult
+}
+
+func newCommandArbiter() *commandArbiter {
+	return &commandArbiter{wake: make(chan struct{}, 1)}
+}
+
+// コマンドを入れて、実行されるまで待つ
+func (a *commandArbiter) do(priority CommandPriority, name string, fn func() error) error {
+	cmd := &droneCommand{name: name, priority: priority, fn: fn, queuedAt: time.Now(), done: make(chan error, 1)}
+
+	a.mu.Lock()
+	if priority == PriorityAutonomous && cmd.queuedAt.Before(a.holdUntil) {
+		a.mu.Unlock()
+		a.record(cmd, ErrPreempted, time.Time{})
+		return ErrPreempted
+	}
+	a.preemptLocked(priority)
+	if priority >= PriorityManual {
+		a.holdLocked(cmd.queuedAt)
+	}
+	a.pending = append(a.pending, cmd)
+	a.mu.Unlock()
+
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+	return <-cmd.done
+}
+
+// 待っているコマンドの中で、priorityより低いものを取り消す
+func (a *commandArbiter) preemptLocked(priority CommandPriority) {
+	kept := a.pending[:0]
+	for _, cmd := range a.pending {
+		if cmd.priority < priority {
+			cmd.done <- ErrPreempted
+			a.recordLocked(cmd, ErrPreempted, time.Time{})
+			continue
+		}
+		kept = append(kept, cmd)
+	}
+	a.pending = kept
+}
+
+func (a *commandArbiter) holdLocked(now time.Time) {
+	if until := now.Add(autonomyHold); until.After(a.holdUntil) {
+		a.holdUntil = until
+	}
+}
+
+// キューを通さないコマンド(emergency)の前に、待っているものを全部取り消す
+func (a *commandArbiter) preemptAll() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.preemptLocked(PriorityEmergency + 1)
+	a.holdLocked(time.Now())
+}
+
+// rcで操縦している間も自動のコマンドを止める
+func (a *commandArbiter) holdAutonomy() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.holdLocked(time.Now())
+}
+
+// 優先度が一番高いコマンドを取り出す。同じ優先度なら先に来た方
+func (a *commandArbiter) next() *droneCommand {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.pending) == 0 {
+		return nil
+	}
+	best := 0
+	for i, cmd := range a.pending {
+		if cmd.priority > a.pending[best].priority {
+			best = i
+		}
+	}
+	cmd := a.pending[best]
+	a.pending = append(a.pending[:best], a.pending[best+1:]...)
+	return cmd
+}
+
+func (a *commandArbiter) run() {
+	for range a.wake {
+		for cmd := a.next(); cmd != nil; cmd = a.next() {
+			started := time.Now()
+			err := cmd.fn()
+			if err != nil {
+				log.Printf("action=commandArbiter command=%s priority=%s err=%s", cmd.name, cmd.priority, err.Error())
+			}
+			a.record(cmd, err, started)
+			cmd.done <- err
+		}
+	}
+}
+
+func (a *commandArbiter) record(cmd *droneCommand, err error, started time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.recordLocked(cmd, err, started)
+}
+
+// startedがゼロの場合は実行されなかったコマンド
+func (a *commandArbiter) recordLocked(cmd *droneCommand, err error, started time.Time) {
+	now := time.Now()
+	r := CommandResult{Name: cmd.name, Priority: cmd.priority.String(), Status: "ok", QueuedAt: cmd.queuedAt}
+	if !started.IsZero() {
+		r.Wait = started.Sub(cmd.queuedAt)
+		r.Duration = now.Sub(started)
+	}
+	if err == ErrPreempted {
+		r.Status = "preempted"
+	} else if err != nil {
+		r.Status = "error"
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if len(a.history) >= commandHistorySize {
+		a.history = append(a.history[:0], a.history[1:]...)
+	}
+	a.history = append(a.history, r)
+}
+
+// 待っているコマンドの数と、直近の結果（新しい順）
+func (a *commandArbiter) status() (int, []CommandResult) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	results := make([]CommandResult, len(a.history))
+	for i, r := range a.history {
+		results[len(a.history)-1-i] = r
+	}
+	return len(a.pending), results
+}
+
+// コマンドキューの状態。GET /api/v1/commands
+type CommandQueueStatus struct {
+	Pending int             `json:"pending"`
+	Recent  []CommandResult `json:"recent"`
+}
+
+func (d *DroneManager) CommandQueue() CommandQueueStatus {
+	pending, recent := d.arbiter.status()
+	return CommandQueueStatus{Pending: pending, Recent: recent}
+}
+
+// ドローンを動かすコマンド。緊急停止中やフェンスから出る時はキューに入れずにエラーにする
+// パイロットの操作なら、patrol等の自動のモードをやめる
+func (d *DroneManager) move(priority CommandPriority, name string, fn func() error) error {
+	if err := d.checkArmed(); err != nil {
+		return err
+	}
+	if err := d.fence.check(priority, name); err != nil {
+		return err
+	}
+	if priority == PriorityManual {
+		d.manualOverride()
+	}
+	return d.arbiter.do(priority, name, fn)
+}
+
+// patrol, tracking, shakeから使う。パイロットの操作より優先度が低い
+type autopilot struct {
+	d *DroneManager
+}
+
+func (d *DroneManager) auto() autopilot {
+	return autopilot{d}
+}
+
+func (a autopilot) move(name string, fn func(int) error, speed int) error {
+	return a.d.move(PriorityAutonomous, name, func() error { return fn(speed) })
+}
+
+func (a autopilot) Up(speed int) error       { return a.move("up", a.d.Driver.Up, speed) }
+func (a autopilot) Down(speed int) error     { return a.move("down", a.d.Driver.Down, speed) }
+func (a autopilot) Forward(speed int) error  { return a.move("forward", a.d.Driver.Forward, speed) }
+func (a autopilot) Backward(speed int) error { return a.move("backward", a.d.Driver.Backward, speed) }
+func (a autopilot) Left(speed int) error     { return a.move("left", a.d.Driver.Left, speed) }
+func (a autopilot) Right(speed int) error    { return a.move("right", a.d.Driver.Right, speed) }
+
+func (a autopilot) Hover() error {
+	return a.d.move(PriorityAutonomous, "hover", func() error {
+		a.d.hover()
+		return nil
+	})
+}
+
+// patrolを止めた時のHover。直前に手動の操作があってもautonomyHoldで捨てられないように、手動の優先度で送る。
+// 緊急停止の後は送らない。patrolを止めた時のHoverで緊急停止を遅らせないように
+func (a autopilot) StopHover() error {
+	if err := a.d.checkArmed(); err != nil {
+		return err
+	}
+	return a.d.arbiter.do(PriorityManual, "hover", func() error {
+		a.d.hover()
+		return nil
+	})
+}
@@ -0,0 +1,268 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/roy1210/Study/Go-drone/gotello/config"
+	"gobot.io/x/gobot/platforms/dji/tello"
+)
+
+const (
+	VideoModeNarrow = "narrow"
+	VideoModeWide   = "wide"
+
+	telloAddr = "192.168.10.1:8889"
+	// TelloのバイナリプロトコルでVideo mode(4:3 / 16:9)を切り替えるコマンド
+	videoModeCommand = 0x0031
+	packetStart      = 0xcc
+	packetTypeSet    = 0x68
+)
+
+var (
+	ErrUnknownBitrate   = errors.New("unknown bitrate")
+	ErrUnknownVideoMode = errors.New("unknown video mode")
+	ErrInvalidExposure  = errors.New("exposure must be 0, 1 or 2")
+)
+
+// APIで使う名前とgobotのVideoBitRate
+var videoBitRates = map[string]tello.VideoBitRate{
+	"auto": tello.VideoBitRateAuto,
+	"1M":   tello.VideoBitRate1M,
+	"1.5M": tello.VideoBitRate15M,
+	"2M":   tello.VideoBitRate2M,
+	"3M":   tello.VideoBitRate3M,
+	"4M":   tello.VideoBitRate4M,
+}
+
+// 今のカメラの設定。接続し直した時にも同じ設定にする
+type VideoSettings struct {
+	Streaming bool   `json:"streaming"`
+	Bitrate   string `json:"bitrate"`
+	Exposure  int    `json:"exposure"`
+	Mode      string `json:"mode"`
+}
+
+// APIで変更したbitrate, exposure, modeはfileにJsonで保存する。
+// config.iniはgitで管理しているので書き換えない
+type cameraSettings struct {
+	mu       sync.Mutex
+	file     string
+	settings VideoSettings
+}
+
+// fileに保存する設定。streamingは保存しない
+type savedCamera struct {
+	Bitrate  string `json:"bitrate"`
+	Exposure int    `json:"exposure"`
+	Mode     string `json:"mode"`
+}
+
+func (c *cameraSettings) get() VideoSettings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.settings
+}
+
+func (c *cameraSettings) update(f func(s *VideoSettings)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f(&c.settings)
+}
+
+// config.iniの[camera]を最初の設定にして、保存した設定があればそちらを使う。おかしな値はデフォルトにする
+func newCameraSettings(file string) *cameraSettings {
+	s := VideoSettings{
+		Streaming: true,
+		Bitrate:   config.Config.CameraBitrate,
+		Exposure:  config.Config.CameraExposure,
+		Mode:      config.Config.CameraVideoMode,
+	}
+	if js, err := os.ReadFile(file); err == nil {
+		saved := savedCamera{Bitrate: s.Bitrate, Exposure: s.Exposure, Mode: s.Mode}
+		if err := json.Unmarshal(js, &saved); err != nil {
+			log.Printf("action=newCameraSettings file=%s err=%s", file, err.Error())
+		} else {
+			s.Bitrate, s.Exposure, s.Mode = saved.Bitrate, saved.Exposure, saved.Mode
+		}
+	} else if !os.IsNotExist(err) {
+		log.Printf("action=newCameraSettings file=%s err=%s", file, err.Error())
+	}
+	if _, ok := videoBitRates[s.Bitrate]; !ok {
+		log.Printf("action=newCameraSettings bitrate=%s err=%s", s.Bitrate, ErrUnknownBitrate.Error())
+		s.Bitrate = "auto"
+	}
+	if s.Exposure < 0 || s.Exposure > 2 {
+		log.Printf("action=newCameraSettings exposure=%d err=%s", s.Exposure, ErrInvalidExposure.Error())
+		s.Exposure = 0
+	}
+	if s.Mode != VideoModeNarrow && s.Mode != VideoModeWide {
+		log.Printf("action=newCameraSettings mode=%s err=%s", s.Mode, ErrUnknownVideoMode.Error())
+		s.Mode = VideoModeNarrow
+	}
+	return &cameraSettings{file: file, settings: s}
+}
+
+// 途中で落ちても壊れたファイルが残らないように、一時ファイルからrenameする
+func (c *cameraSettings) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	js, err := json.MarshalIndent(savedCamera{Bitrate: c.settings.Bitrate, Exposure: c.settings.Exposure, Mode: c.settings.Mode}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.file + ".tmp"
+	if err := os.WriteFile(tmp, js, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.file)
+}
+
+// 接続した時に、前回選んだbitrate, exposure, modeをドローンに送る
+func (d *DroneManager) applyCameraSettings() {
+	s := d.camera.get()
+	if rate, ok := videoBitRates[s.Bitrate]; ok {
+		if err := d.SetVideoEncoderRate(rate); err != nil {
+			log.Printf("action=applyCameraSettings bitrate=%s err=%s", s.Bitrate, err.Error())
+		}
+	}
+	if err := d.SetExposure(s.Exposure); err != nil {
+		log.Printf("action=applyCameraSettings exposure=%d err=%s", s.Exposure, err.Error())
+	}
+	if err := d.sendVideoMode(s.Mode); err != nil {
+		log.Printf("action=applyCameraSettings mode=%s err=%s", s.Mode, err.Error())
+	}
+}
+
+// 次の接続でも同じ設定になるように保存する。
+// 保存に失敗してもドローンの設定は変わっているので、ログだけにする
+func (d *DroneManager) saveCameraSettings() {
+	if err := d.camera.save(); err != nil {
+		log.Printf("action=saveCameraSettings err=%s", err.Error())
+	}
+}
+
+func (d *DroneManager) VideoSettings() VideoSettings {
+	return d.camera.get()
+}
+
+func (d *DroneManager) IsVideoStreaming() bool {
+	return d.camera.get().Streaming
+}
+
+// ビデオの要求を再開する。100ミリセカンド毎のStartVideoも再開する
+func (d *DroneManager) StartVideoStream() error {
+	d.camera.update(func(s *VideoSettings) { s.Streaming = true })
+	return d.StartVideo()
+}
+
+// Telloにはビデオを止めるコマンドが無いので、StartVideoの要求をやめて、届いたパケットも捨てる
+func (d *DroneManager) StopVideoStream() {
+	d.camera.update(func(s *VideoSettings) { s.Streaming = false })
+}
+
+// bitrateは auto, 1M, 1.5M, 2M, 3M, 4M
+func (d *DroneManager) SetBitrate(bitrate string) error {
+	rate, ok := videoBitRates[bitrate]
+	if !ok {
+		return ErrUnknownBitrate
+	}
+	if err := d.SetVideoEncoderRate(rate); err != nil {
+		return err
+	}
+	d.camera.update(func(s *VideoSettings) { s.Bitrate = bitrate })
+	d.saveCameraSettings()
+	return nil
+}
+
+// カメラの露光レベル
+func (d *DroneManager) SetExposureLevel(level int) error {
+	if level < 0 || level > 2 {
+		return ErrInvalidExposure
+	}
+	if err := d.SetExposure(level); err != nil {
+		return err
+	}
+	d.camera.update(func(s *VideoSettings) { s.Exposure = level })
+	d.saveCameraSettings()
+	return nil
+}
+
+// narrow: 4:3 (960x720), wide: 16:9 (1280x720)
+func (d *DroneManager) SetVideoMode(mode string) error {
+	if err := d.sendVideoMode(mode); err != nil {
+		return err
+	}
+	d.camera.update(func(s *VideoSettings) { s.Mode = mode })
+	d.saveCameraSettings()
+	return nil
+}
+
+// gobotのDriverにはVideo modeの切り替えが無いので、パケットを作って直接送る
+func (d *DroneManager) sendVideoMode(mode string) error {
+	var payload byte
+	switch mode {
+	case VideoModeNarrow:
+		payload = 0
+	case VideoModeWide:
+		payload = 1
+	default:
+		return ErrUnknownVideoMode
+	}
+
+	conn, err := net.Dial("udp", telloAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(telloPacket(videoModeCommand, []byte{payload}))
+	return err
+}
+
+// Telloのパケット: 0xcc, 長さ<<3 (2byte), crc8, type, command (2byte), seq (2byte), payload, crc16
+func telloPacket(command uint16, payload []byte) []byte {
+	size := 11 + len(payload)
+	pkt := make([]byte, 0, size)
+	pkt = append(pkt, packetStart, byte(size<<3), byte(size>>5))
+	pkt = append(pkt, telloCRC8(pkt))
+	pkt = append(pkt, packetTypeSet, byte(command), byte(command>>8), 0, 0)
+	pkt = append(pkt, payload...)
+	crc := telloCRC16(pkt)
+	return append(pkt, byte(crc), byte(crc>>8))
+}
+
+// CRC-8 (reflected 0x31), 初期値0x77
+func telloCRC8(data []byte) byte {
+	crc := byte(0x77)
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x8c
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// CRC-16 (reflected 0x1021), 初期値0x3692
+func telloCRC16(data []byte) uint16 {
+	crc := uint16(0x3692)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
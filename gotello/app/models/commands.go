@@ -0,0 +1,170 @@
+package models
+
+import (
+	"sync"
+	"time"
+)
+
+// パイロットの操作(HTTP, gamepad, keyboard)はDroneManagerのメソッドで実行する。
+// DriverのメソッドをDroneManagerで上書きして、全部コマンドキューを通す。
+// 緊急停止中はドローンを動かすコマンドをErrEmergencyLatchedにする
+
+// Groundedの時だけ離陸できる。飛んだかどうかはテレメトリで見てManualにする
+func (d *DroneManager) takeOff(name string, fn func() error) error {
+	if err := d.checkArmed(); err != nil {
+		return err
+	}
+	if _, err := d.state.transition(ModeTakingOff, name, ModeGrounded); err != nil {
+		return err
+	}
+	err := d.arbiter.do(PriorityManual, name, fn)
+	if err != nil {
+		d.state.transition(ModeGrounded, name+" failed", ModeTakingOff)
+	}
+	return err
+}
+
+func (d *DroneManager) TakeOff() error {
+	return d.takeOff("takeOff", d.Driver.TakeOff)
+}
+
+func (d *DroneManager) ThrowTakeOff() error {
+	return d.takeOff("throwTakeOff", d.Driver.ThrowTakeOff)
+}
+
+func (d *DroneManager) Up(speed int) error {
+	return d.move(PriorityManual, "up", func() error { return d.Driver.Up(speed) })
+}
+
+func (d *DroneManager) Down(speed int) error {
+	return d.move(PriorityManual, "down", func() error { return d.Driver.Down(speed) })
+}
+
+func (d *DroneManager) Forward(speed int) error {
+	return d.move(PriorityManual, "forward", func() error { return d.Driver.Forward(speed) })
+}
+
+func (d *DroneManager) Backward(speed int) error {
+	return d.move(PriorityManual, "backward", func() error { return d.Driver.Backward(speed) })
+}
+
+func (d *DroneManager) Left(speed int) error {
+	return d.move(PriorityManual, "left", func() error { return d.Driver.Left(speed) })
+}
+
+func (d *DroneManager) Right(speed int) error {
+	return d.move(PriorityManual, "right", func() error { return d.Driver.Right(speed) })
+}
+
+// 回転はodometryのyawに記録する
+func (d *DroneManager) Clockwise(speed int) error {
+	return d.move(PriorityManual, "clockwise", func() error {
+		d.odometry.setYawStick(float64(speed)/100, time.Now())
+		return d.Driver.Clockwise(speed)
+	})
+}
+
+func (d *DroneManager) CounterClockwise(speed int) error {
+	return d.move(PriorityManual, "counterClockwise", func() error {
+		d.odometry.setYawStick(-float64(speed)/100, time.Now())
+		return d.Driver.CounterClockwise(speed)
+	})
+}
+
+func (d *DroneManager) FrontFlip() error {
+	return d.move(PriorityManual, "frontFlip", d.Driver.FrontFlip)
+}
+
+func (d *DroneManager) BackFlip() error {
+	return d.move(PriorityManual, "backFlip", d.Driver.BackFlip)
+}
+
+func (d *DroneManager) LeftFlip() error {
+	return d.move(PriorityManual, "leftFlip", d.Driver.LeftFlip)
+}
+
+func (d *DroneManager) RightFlip() error {
+	return d.move(PriorityManual, "rightFlip", d.Driver.RightFlip)
+}
+
+func (d *DroneManager) Bounce() error {
+	return d.move(PriorityManual, "bounce", d.Driver.Bounce)
+}
+
+// スティックも0に戻してからHoverする。rcの値が残っているとHoverしてもすぐ動き出すため
+func (d *DroneManager) Hover() {
+	d.manualOverride()
+	d.rc.reset()
+	d.arbiter.do(PriorityManual, "hover", func() error {
+		d.hover()
+		return nil
+	})
+}
+
+// durationMsを指定した移動の後のHover。Hoverする前に別の移動のコマンドが来たら取り消す。
+// 時間が来た後でも、キューで待っている間に取り消されたらHoverしないように世代(gen)で確かめる
+type hoverTimer struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	gen   int
+}
+
+func (h *hoverTimer) schedule(delay time.Duration, fn func(gen int)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cancelLocked()
+	gen := h.gen
+	h.timer = time.AfterFunc(delay, func() { fn(gen) })
+}
+
+func (h *hoverTimer) cancel() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cancelLocked()
+}
+
+func (h *hoverTimer) cancelLocked() {
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+	h.gen++
+}
+
+func (h *hoverTimer) pending(gen int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.gen == gen
+}
+
+// delayが経ったらHoverする。前に予約したHoverは取り消す
+func (d *DroneManager) HoverAfter(delay time.Duration) {
+	d.hoverTimer.schedule(delay, func(gen int) {
+		d.arbiter.do(PriorityManual, "hover", func() error {
+			if !d.hoverTimer.pending(gen) {
+				return nil
+			}
+			d.rc.reset()
+			d.hover()
+			return nil
+		})
+	})
+}
+
+func (d *DroneManager) CeaseRotation() {
+	d.manualOverride()
+	d.arbiter.do(PriorityManual, "ceaseRotation", func() error {
+		d.odometry.setYawStick(0, time.Now())
+		d.Driver.CeaseRotation()
+		return nil
+	})
+}
+
+// 着陸は手動の操作より優先する。Landingのモードになるのでpatrolとtrackingも止まる
+func (d *DroneManager) Land() error {
+	if d.FlightMode().Airborne() {
+		d.state.transition(ModeLanding, "land")
+	}
+	d.rc.reset()
+	return d.arbiter.do(PriorityLand, "land", d.Driver.Land)
+}
@@ -0,0 +1,362 @@
+package models
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+
+	"github.com/roy1210/Study/Go-drone/gotello/config"
+)
+
+const (
+	decoderMinBackoff = 500 * time.Millisecond
+	decoderMaxBackoff = 30 * time.Second
+)
+
+const (
+	DecoderFFmpeg = "ffmpeg"
+	DecoderGoCV   = "gocv"
+)
+
+var (
+	ErrDecoderNotStarted = errors.New("decoder is not started")
+	ErrUnknownDecoder    = errors.New("unknown decoder")
+)
+
+// H.264をデコードしてframeの大きさのrawvideoにする。
+// Writeにドローンからのパケットを書き込み、ReadFrameで1フレームずつ読む。
+// ReadFrameはStreamVideoのGoroutineからだけ呼ばれる。
+type VideoDecoder interface {
+	Start() error
+	Write(pkt []byte) error
+	ReadFrame(buf []byte) error
+	Health() DecoderHealth
+	Close() error
+}
+
+// configのdecoderの名前から実装を選ぶ
+func NewVideoDecoder(name string, frame FrameGeometry) (VideoDecoder, error) {
+	switch name {
+	case DecoderFFmpeg, "":
+		return newFFmpegDecoder(frame, config.Config.VideoHWAccel, config.Config.VideoHWAccelDevice), nil
+	case DecoderGoCV:
+		return newGoCVDecoder(frame, config.Config.VideoGoCVUDPPort), nil
+	}
+	return nil, ErrUnknownDecoder
+}
+
+// pixel formatとgocvのMatType, 1pixelあたりのbyte数。
+// gocvのIMEncode, HUD, 顔検出はBGRの順番を前提にしているのでrgb24は使えない
+var pixelFormats = map[string]struct {
+	matType  gocv.MatType
+	channels int
+}{
+	"bgr24": {gocv.MatTypeCV8UC3, 3},
+	"gray":  {gocv.MatTypeCV8UC1, 1},
+}
+
+// フレームの大きさはconfigから起動時に計算する。重くならないように小さくする。
+type FrameGeometry struct {
+	Width  int
+	Height int
+	// フレームの中間のポイント、座標
+	CenterX int
+	CenterY int
+	Area    int
+	// 1フレームのbyte数。bgr24なら3次元の配列を持つ
+	Size     int
+	PixFmt   string
+	MatType  gocv.MatType
+	Channels int
+}
+
+// 未対応のpixel formatはbgr24にする
+func NewFrameGeometry(width, height int, pixFmt string) FrameGeometry {
+	format, ok := pixelFormats[pixFmt]
+	if !ok {
+		log.Printf("action=NewFrameGeometry unsupported pix_fmt=%s use bgr24", pixFmt)
+		pixFmt = "bgr24"
+		format = pixelFormats[pixFmt]
+	}
+	area := width * height
+	return FrameGeometry{
+		Width:    width,
+		Height:   height,
+		CenterX:  width / 2,
+		CenterY:  height / 2,
+		Area:     area,
+		Size:     area * format.channels,
+		PixFmt:   pixFmt,
+		MatType:  format.matType,
+		Channels: format.channels,
+	}
+}
+
+// ffmpegでH.264をrawvideoにデコードする。pipe:0に書き込み、pipe:1から読む
+// ffmpegが落ちた場合はbackoffを入れて再起動し、次のキーフレームから書き込みを再開する。
+// hwaccelの初期化に失敗してffmpegが落ちた場合は、ソフトウェアデコードで再起動する。
+type ffmpegDecoder struct {
+	mu            sync.Mutex
+	frame         FrameGeometry
+	hwaccel       string
+	hwaccelDevice string
+	useHWAccel    bool
+	cmd           *exec.Cmd
+	in            io.WriteCloser
+	out           io.ReadCloser
+	waitKeyframe  bool
+	// stdinに書けなくなったら、再起動するまでパケットを捨てる
+	inFailed      bool
+	backoff       time.Duration
+	decodedFrames int
+	stats         decoderStats
+}
+
+// デコーダーの状態。API経由で返す
+type DecoderHealth struct {
+	Running     bool      `json:"running"`
+	HWAccel     bool      `json:"hwaccel"`
+	FPS         float64   `json:"fps"`
+	Frames      int       `json:"frames"`
+	Restarts    int       `json:"restarts"`
+	LastError   string    `json:"lastError"`
+	LastErrorAt time.Time `json:"lastErrorAt"`
+	LastFrameAt time.Time `json:"lastFrameAt"`
+}
+
+// デコーダー共通のfps等の集計。ロックは呼び出し側で取る
+type decoderStats struct {
+	health    DecoderHealth
+	fpsFrames int
+	fpsStart  time.Time
+}
+
+func (s *decoderStats) frameDecoded() {
+	now := time.Now()
+	s.health.Frames++
+	s.health.LastFrameAt = now
+
+	// 1秒毎にfpsを計算する
+	s.fpsFrames++
+	if s.fpsStart.IsZero() {
+		s.fpsStart = now
+	}
+	if elapsed := now.Sub(s.fpsStart); elapsed >= time.Second {
+		s.health.FPS = float64(s.fpsFrames) / elapsed.Seconds()
+		s.fpsFrames = 0
+		s.fpsStart = now
+	}
+}
+
+func (s *decoderStats) resetFPS() {
+	s.fpsFrames = 0
+	s.fpsStart = time.Time{}
+	s.health.FPS = 0
+}
+
+func (s *decoderStats) setError(err error) {
+	s.health.LastError = err.Error()
+	s.health.LastErrorAt = time.Now()
+}
+
+// フレームが途切れている場合はfpsを0にする
+func (s *decoderStats) snapshot() DecoderHealth {
+	health := s.health
+	if time.Since(health.LastFrameAt) > 2*time.Second {
+		health.FPS = 0
+	}
+	return health
+}
+
+// hwaccelが空の場合はソフトウェアデコード
+func newFFmpegDecoder(frame FrameGeometry, hwaccel, hwaccelDevice string) *ffmpegDecoder {
+	return &ffmpegDecoder{
+		frame:         frame,
+		hwaccel:       hwaccel,
+		hwaccelDevice: hwaccelDevice,
+		useHWAccel:    hwaccel != "",
+		backoff:       decoderMinBackoff,
+	}
+}
+
+func (f *ffmpegDecoder) args() []string {
+	var args []string
+	// -hwaccel 動画を走らせる時ハードか、ソフトかどっちが良い
+	if f.useHWAccel {
+		args = append(args, "-hwaccel", f.hwaccel)
+		if f.hwaccelDevice != "" {
+			args = append(args, "-hwaccel_device", f.hwaccelDevice)
+		}
+	}
+	return append(args, "-i", "pipe:0", "-pix_fmt", f.frame.PixFmt,
+		"-s", strconv.Itoa(f.frame.Width)+"x"+strconv.Itoa(f.frame.Height), "-f", "rawvideo", "pipe:1")
+}
+
+func (f *ffmpegDecoder) Start() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.start()
+	if err != nil {
+		f.stats.setError(err)
+	}
+	return err
+}
+
+func (f *ffmpegDecoder) start() error {
+	cmd := exec.Command("ffmpeg", f.args()...)
+	// 取り込むときはIn,出すときはOut
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	f.cmd, f.in, f.out = cmd, in, out
+	// 途中のPフレームからではデコードできないので、キーフレームまで捨てる
+	f.waitKeyframe = true
+	f.inFailed = false
+	f.decodedFrames = 0
+	f.stats.health.Running = true
+	f.stats.health.HWAccel = f.useHWAccel
+	log.Printf("action=ffmpegDecoder.start hwaccel=%v", f.useHWAccel)
+	return nil
+}
+
+func (f *ffmpegDecoder) stop() {
+	if f.cmd == nil {
+		return
+	}
+	f.in.Close()
+	f.cmd.Process.Kill()
+	f.cmd.Wait()
+	f.cmd, f.in, f.out = nil, nil, nil
+	f.stats.health.Running = false
+}
+
+func (f *ffmpegDecoder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stop()
+	return nil
+}
+
+// 再起動中とキーフレーム待ちの間はパケットを捨てる。
+// ffmpegが落ちると書き込みは全部EPIPEになるので、ログは止まった時の1回だけにする
+func (f *ffmpegDecoder) Write(pkt []byte) error {
+	f.mu.Lock()
+	in := f.in
+	if in == nil || f.inFailed {
+		f.mu.Unlock()
+		return nil
+	}
+	if f.waitKeyframe {
+		if !containsKeyframe(pkt) {
+			f.mu.Unlock()
+			return nil
+		}
+		f.waitKeyframe = false
+	}
+	f.mu.Unlock()
+
+	if _, err := in.Write(pkt); err != nil {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.in == in && !f.inFailed {
+			log.Printf("action=ffmpegDecoder.Write err=%s drop packets until restart", err.Error())
+			f.inFailed = true
+			f.stats.setError(err)
+		}
+	}
+	return nil
+}
+
+// bufにはframe.Size分の1フレームが入る
+// 読み込みに失敗した場合は、ffmpegを再起動してからエラーを返す
+func (f *ffmpegDecoder) ReadFrame(buf []byte) error {
+	f.mu.Lock()
+	out := f.out
+	f.mu.Unlock()
+	if out == nil {
+		f.restart(ErrDecoderNotStarted)
+		return ErrDecoderNotStarted
+	}
+
+	if _, err := io.ReadFull(out, buf); err != nil {
+		f.restart(err)
+		return err
+	}
+	f.frameDecoded()
+	return nil
+}
+
+func (f *ffmpegDecoder) frameDecoded() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.decodedFrames++
+	f.backoff = decoderMinBackoff
+	f.stats.frameDecoded()
+}
+
+// ffmpegを止めて、backoffの時間待ってから起動し直す。
+// 連続で失敗する度にbackoffを倍にし、デコードに成功したら戻す。
+func (f *ffmpegDecoder) restart(cause error) {
+	f.mu.Lock()
+	f.stop()
+	f.stats.setError(cause)
+	backoff := f.backoff
+	// 1フレームもデコードできずにffmpegが終了した場合は、hwaccelの初期化に失敗したとみなす
+	if f.useHWAccel && f.decodedFrames == 0 && cause != ErrDecoderNotStarted {
+		log.Printf("action=ffmpegDecoder.restart hwaccel failed, fallback to software err=%s", cause.Error())
+		f.useHWAccel = false
+		backoff = 0
+	} else {
+		log.Printf("action=ffmpegDecoder.restart backoff=%s err=%s", backoff, cause.Error())
+		f.backoff *= 2
+		if f.backoff > decoderMaxBackoff {
+			f.backoff = decoderMaxBackoff
+		}
+	}
+	f.stats.resetFPS()
+	f.mu.Unlock()
+
+	time.Sleep(backoff)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stats.health.Restarts++
+	if err := f.start(); err != nil {
+		log.Printf("action=ffmpegDecoder.restart err=%s", err.Error())
+		f.stats.setError(err)
+	}
+}
+
+func (f *ffmpegDecoder) Health() DecoderHealth {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stats.snapshot()
+}
+
+// パケットの中にSPSかIDRのNALユニットがあるか
+func containsKeyframe(pkt []byte) bool {
+	for i := 0; i+3 < len(pkt); i++ {
+		if pkt[i] != 0 || pkt[i+1] != 0 || pkt[i+2] != 1 {
+			continue
+		}
+		nalType := pkt[i+3] & 0x1f
+		if nalType == nalTypeSPS || nalType == nalTypeIDR {
+			return true
+		}
+	}
+	return false
+}
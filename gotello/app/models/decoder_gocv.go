@@ -0,0 +1,163 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+var errGoCVReadFailed = errors.New("gocv: failed to read frame")
+
+// OpenCV(libavcodec)でプロセス内でデコードする。ffmpegのサブプロセスとpipeが不要になる。
+// VideoCaptureはpipeからは読めないので、パケットをローカルのUDPに流してVideoCaptureで受ける。
+// VideoCaptureはBGRで返すので、frameの大きさとpixel formatに変換してから渡す。
+type gocvDecoder struct {
+	mu      sync.Mutex
+	frame   FrameGeometry
+	port    int
+	conn    net.Conn
+	capture *gocv.VideoCapture
+	img     gocv.Mat
+	resized gocv.Mat
+	// VideoCaptureが開くまでUDPの書き込みは失敗する。ログは状態が変わった時だけ
+	writeFailing bool
+	backoff      time.Duration
+	stats        decoderStats
+}
+
+func newGoCVDecoder(frame FrameGeometry, port int) *gocvDecoder {
+	return &gocvDecoder{
+		frame:   frame,
+		port:    port,
+		img:     gocv.NewMat(),
+		resized: gocv.NewMat(),
+		backoff: decoderMinBackoff,
+	}
+}
+
+func (g *gocvDecoder) address() string {
+	return fmt.Sprintf("127.0.0.1:%d", g.port)
+}
+
+func (g *gocvDecoder) Start() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	conn, err := net.Dial("udp", g.address())
+	if err != nil {
+		g.stats.setError(err)
+		return err
+	}
+	g.conn = conn
+	return nil
+}
+
+func (g *gocvDecoder) Write(pkt []byte) error {
+	g.mu.Lock()
+	conn := g.conn
+	g.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	_, err := conn.Write(pkt)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if failing := err != nil; failing != g.writeFailing {
+		g.writeFailing = failing
+		if failing {
+			log.Printf("action=gocvDecoder.Write err=%s drop packets until the capture is open", err.Error())
+		} else {
+			log.Printf("action=gocvDecoder.Write resumed")
+		}
+	}
+	return nil
+}
+
+// VideoCaptureはストリームが流れてくるまでブロックするので、最初のReadFrameで開く
+func (g *gocvDecoder) ReadFrame(buf []byte) error {
+	g.mu.Lock()
+	capture := g.capture
+	g.mu.Unlock()
+
+	if capture == nil {
+		var err error
+		capture, err = gocv.VideoCaptureFile("udp://" + g.address())
+		if err != nil {
+			g.fail(err)
+			return err
+		}
+		g.mu.Lock()
+		g.capture = capture
+		g.stats.health.Running = true
+		g.mu.Unlock()
+		log.Printf("action=gocvDecoder.ReadFrame opened udp://%s", g.address())
+	}
+
+	if !capture.Read(&g.img) || g.img.Empty() {
+		g.fail(errGoCVReadFailed)
+		return errGoCVReadFailed
+	}
+
+	gocv.Resize(g.img, &g.resized, image.Pt(g.frame.Width, g.frame.Height), 0, 0, gocv.InterpolationLinear)
+	if g.frame.PixFmt == "gray" {
+		gocv.CvtColor(g.resized, &g.resized, gocv.ColorBGRToGray)
+	}
+	copy(buf, g.resized.ToBytes())
+
+	g.mu.Lock()
+	g.backoff = decoderMinBackoff
+	g.stats.frameDecoded()
+	g.mu.Unlock()
+	return nil
+}
+
+// VideoCaptureを閉じて、backoffの時間待つ。次のReadFrameで開き直す
+func (g *gocvDecoder) fail(cause error) {
+	g.mu.Lock()
+	if g.capture != nil {
+		g.capture.Close()
+		g.capture = nil
+		g.stats.health.Restarts++
+	}
+	g.stats.health.Running = false
+	g.stats.setError(cause)
+	g.stats.resetFPS()
+	backoff := g.backoff
+	g.backoff *= 2
+	if g.backoff > decoderMaxBackoff {
+		g.backoff = decoderMaxBackoff
+	}
+	g.mu.Unlock()
+
+	log.Printf("action=gocvDecoder.fail backoff=%s err=%s", backoff, cause.Error())
+	time.Sleep(backoff)
+}
+
+func (g *gocvDecoder) Health() DecoderHealth {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.stats.snapshot()
+}
+
+// ReadFrameのGoroutineが止まってから呼ぶ
+func (g *gocvDecoder) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.capture != nil {
+		g.capture.Close()
+		g.capture = nil
+	}
+	if g.conn != nil {
+		g.conn.Close()
+		g.conn = nil
+	}
+	g.stats.health.Running = false
+	g.img.Close()
+	g.resized.Close()
+	return nil
+}
@@ -0,0 +1,211 @@
+package models
+
+import (
+	"image"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	// これより古い検出結果は表示しない
+	detectionStaleAfter = time.Second
+	// 検出時間とフレーム間隔の移動平均の重み
+	detectEWMAWeight = 0.2
+)
+
+// 検出に渡すフレーム。genはSubmitした時のResetの回数
+type detectFrame struct {
+	img gocv.Mat
+	gen uint64
+}
+
+type detection struct {
+	rects []image.Rectangle
+	at    time.Time
+}
+
+// 顔検出を別のGoroutineで走らせて、ストリームを止めないようにする。
+// 検出が追いつかない場合は古いフレームを捨てて、最新のフレームだけ検出する。
+// 検出にかかった時間から、何フレーム毎に検出するか(every)を自動で決める。
+// 検出の間のフレームは、前回から今回の検出までの動きで、枠の今の位置を予測(外挿)する。
+// Resetする度にgenを増やして、Resetの前に渡したフレームの結果は使わない。
+type faceDetector struct {
+	frames     chan detectFrame
+	onDetect   func(rects []image.Rectangle)
+	metrics    *VideoMetrics
+	mu         sync.Mutex
+	prev       detection
+	cur        detection
+	latency    float64
+	interval   float64
+	lastSubmit time.Time
+	every      int
+	count      int
+	gen        uint64
+}
+
+func newFaceDetector(metrics *VideoMetrics, onDetect func(rects []image.Rectangle)) *faceDetector {
+	return &faceDetector{
+		frames:   make(chan detectFrame, 1),
+		onDetect: onDetect,
+		metrics:  metrics,
+		every:    1,
+	}
+}
+
+// classifierはこのGoroutineの中だけで使う
+func (f *faceDetector) Run(classifier *gocv.CascadeClassifier) {
+	for frame := range f.frames {
+		start := time.Now()
+		rects := classifier.DetectMultiScale(frame.img)
+		elapsed := time.Since(start)
+		frame.img.Close()
+
+		f.metrics.Detect.Observe(elapsed)
+		f.metrics.FramesDetected.Inc()
+
+		f.mu.Lock()
+		// 検出している間にトラッキングが止められていたら、古い枠もコマンドも使わない
+		if frame.gen != f.gen {
+			f.mu.Unlock()
+			continue
+		}
+		f.prev = f.cur
+		f.cur = detection{rects: rects, at: time.Now()}
+		f.latency = ewma(f.latency, elapsed.Seconds())
+		f.updateEvery()
+		f.mu.Unlock()
+
+		f.onDetect(rects)
+	}
+}
+
+// 検出にかかる時間がフレーム何枚分かで、次に検出するまでのフレーム数を決める
+func (f *faceDetector) updateEvery() {
+	if f.interval <= 0 {
+		return
+	}
+	every := int(math.Ceil(f.latency / f.interval))
+	if every < 1 {
+		every = 1
+	}
+	if every != f.every {
+		log.Printf("action=faceDetector.updateEvery every=%d latency=%.1fms", every, f.latency*1000)
+		f.every = every
+	}
+}
+
+// everyフレーム毎に検出用のGoroutineへ渡す。
+// 前のフレームがまだ検出されていない場合は捨てて、最新のフレームに入れ替える。
+func (f *faceDetector) Submit(img gocv.Mat) {
+	f.mu.Lock()
+	now := time.Now()
+	if !f.lastSubmit.IsZero() {
+		f.interval = ewma(f.interval, now.Sub(f.lastSubmit).Seconds())
+	}
+	f.lastSubmit = now
+	f.count++
+	skip := f.count%f.every != 0
+	gen := f.gen
+	f.mu.Unlock()
+	if skip {
+		return
+	}
+
+	frame := detectFrame{img: img.Clone(), gen: gen}
+	select {
+	case f.frames <- frame:
+		return
+	default:
+	}
+	f.drop()
+	select {
+	case f.frames <- frame:
+	default:
+		frame.img.Close()
+	}
+}
+
+// 検出を待っているフレームを捨てる
+func (f *faceDetector) drop() {
+	select {
+	case old := <-f.frames:
+		old.img.Close()
+	default:
+	}
+}
+
+// トラッキングをやめた時は、古い枠を表示しないように消す。
+// 待っているフレームも捨てて、検出中の結果はgenが違うのでRunが捨てる
+func (f *faceDetector) Reset() {
+	f.mu.Lock()
+	f.prev = detection{}
+	f.cur = detection{}
+	f.lastSubmit = time.Time{}
+	f.count = 0
+	f.gen++
+	f.mu.Unlock()
+	f.drop()
+}
+
+// 今表示する枠。前回から今回の検出までと同じ速さで動き続けるとして、今の時間の位置を予測する。
+// 補間(前回と今回の間)だと、検出の遅れの分だけ枠がさらに遅れるので外挿にしている
+func (f *faceDetector) Boxes(now time.Time) []image.Rectangle {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cur.at.IsZero() || now.Sub(f.cur.at) > detectionStaleAfter {
+		return nil
+	}
+	if f.prev.at.IsZero() {
+		return f.cur.rects
+	}
+	span := f.cur.at.Sub(f.prev.at).Seconds()
+	if span <= 0 {
+		return f.cur.rects
+	}
+	// 予測するのは次の検出までの間(1回分の動き)だけ。それより先は外れやすいので止める
+	t := math.Max(0, math.Min(now.Sub(f.cur.at).Seconds()/span, 1))
+
+	boxes := make([]image.Rectangle, 0, len(f.cur.rects))
+	for _, r := range f.cur.rects {
+		p, ok := nearestRect(f.prev.rects, r)
+		if !ok {
+			boxes = append(boxes, r)
+			continue
+		}
+		boxes = append(boxes, image.Rect(
+			extrapolate(r.Min.X, r.Min.X-p.Min.X, t), extrapolate(r.Min.Y, r.Min.Y-p.Min.Y, t),
+			extrapolate(r.Max.X, r.Max.X-p.Max.X, t), extrapolate(r.Max.Y, r.Max.Y-p.Max.Y, t)))
+	}
+	return boxes
+}
+
+// 中心が枠の幅より近いものを同じ顔とみなす
+func nearestRect(rects []image.Rectangle, r image.Rectangle) (image.Rectangle, bool) {
+	center := r.Min.Add(r.Max).Div(2)
+	best, bestDist := image.Rectangle{}, math.MaxFloat64
+	for _, c := range rects {
+		diff := c.Min.Add(c.Max).Div(2).Sub(center)
+		dist := math.Hypot(float64(diff.X), float64(diff.Y))
+		if dist < bestDist {
+			best, bestDist = c, dist
+		}
+	}
+	return best, bestDist < float64(r.Dx())
+}
+
+// baseから、1回の検出の間の動きdeltaのt倍だけ進める
+func extrapolate(base, delta int, t float64) int {
+	return base + int(math.Round(float64(delta)*t))
+}
+
+func ewma(avg, value float64) float64 {
+	if avg == 0 {
+		return value
+	}
+	return avg*(1-detectEWMAWeight) + value*detectEWMAWeight
+}
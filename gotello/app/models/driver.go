@@ -0,0 +1,30 @@
+package models
+
+import "gobot.io/x/gobot/platforms/dji/tello"
+
+// DroneManagerが使うtello.Driverのメソッド。
+// ドローンに繋がずにテストする時は、これを満たす偽物のDriverを渡す
+type Driver interface {
+	TakeOff() error
+	ThrowTakeOff() error
+	Land() error
+	Up(val int) error
+	Down(val int) error
+	Forward(val int) error
+	Backward(val int) error
+	Left(val int) error
+	Right(val int) error
+	Clockwise(val int) error
+	CounterClockwise(val int) error
+	FrontFlip() error
+	BackFlip() error
+	LeftFlip() error
+	RightFlip() error
+	Bounce() error
+	Hover()
+	CeaseRotation()
+	SetVector(x, y, z, psi float64) error
+	StartVideo() error
+	SetVideoEncoderRate(rate tello.VideoBitRate) error
+	SetExposure(level int) error
+}
@@ -2,14 +2,14 @@ package models
 
 import (
 	"context"
+	"errors"
 	"image"
 	"image/color"
-	"io"
 	"io/ioutil"
 	"log"
 	"math"
-	"os/exec"
-	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hybridgroup/mjpeg"
@@ -17,72 +17,81 @@ import (
 	"gobot.io/x/gobot/platforms/dji/tello"
 	"gocv.io/x/gocv"
 	"golang.org/x/sync/semaphore"
+
+	"github.com/roy1210/Study/Go-drone/gotello/config"
+)
+
+var (
+	ErrAlreadyShaking = errors.New("already shaking")
+	ErrShakeNotFlying = errors.New("shake needs the drone to be flying")
 )
 
 const (
-	DefaultSpeed = 10
-	// フレーム設定。 重くならないように、小さくする。
+	DefaultSpeed      = 10
 	WaitDroneStartSec = 5
-	frameX            = 960 / 3
-	frameY            = 720 / 3
-	// フレームの中間のポイント、座標
-	frameCenterX = frameX / 2
-	frameCenterY = frameY / 2
-	frameArea    = frameX * frameY
-	// ffmpeg は3次元の配列を持つ
-	frameSize         = frameArea * 3
 	faceDetectXMLFile = "./app/models/haarcascade_frontalface_default.xml"
 	snapshotsFolder   = "./static/img/snapshots/"
 )
 
 // 3rd partyのファイルを書き換えることはせず、必要な物は自分で足す。
-// patrol: Droneが自動で巡回する。
-// SemaphoreでパトロールがGoroutineから１つだけ実行するようにする。
-// ffmpeg: pipe 1 でのストリーミング設定
+// patrol: Droneが自動で巡回する。patrolControllerが1つだけGoroutineを動かす。
+// state: 飛行モード(Grounded, Manual, Patrol, Tracking等)。patrolやtrackingはモードで判断する。
+// decoder: H.264のデコード。configでffmpegかgocvを選ぶ。frameはconfigから起動時に計算する。
 type DroneManager struct {
-	*tello.Driver
-	Speed                int
-	patrolSem            *semaphore.Weighted
-	patrolQuit           chan bool
-	isPatrolling         bool
-	ffmpegIn             io.WriteCloser
-	ffmpegOut            io.ReadCloser
-	Stream               *mjpeg.Stream
-	faceDetectTrackingOn bool
-	isSnapShot           bool
+	Driver
+	speed          atomic.Int32
+	patrol         *patrolController
+	shakeSem       *semaphore.Weighted
+	state          *flightStateMachine
+	arbiter        *commandArbiter
+	rc             *rcController
+	hoverTimer     hoverTimer
+	fence          *geofence
+	odometry       *odometry
+	sdk            *sdkClient
+	emergencyMu    sync.Mutex
+	emergencySDK   *sdkClient
+	pads           *padStore
+	mission        *missionController
+	camera         *cameraSettings
+	frame          FrameGeometry
+	jpegQuality    int
+	decoder        VideoDecoder
+	Stream         *mjpeg.Stream
+	WebRTC         *WebRTCPublisher
+	Restream       *Restreamer
+	Metrics        *VideoMetrics
+	telemetry      telemetryStore
+	snapshotReq    chan chan struct{}
+	showMetricsHUD atomic.Bool
 }
 
 // Droneの基本動作設定
 func NewDroneManager() *DroneManager {
 	drone := tello.NewDriver("8889")
+	droneManager := NewDroneManagerWithDriver(drone)
+	decoder := droneManager.decoder
 
-	// ffmpegを走らせる。コマンドを打つ感じで。Pipe 0に書き込む
-	// -hwaccel 動画を走らせる時ハードか、ソフトかどっちが良い
-	ffmpeg := exec.Command("ffmpeg", "-hwaccel", "auto", "-hwaccel_device", "opencl", "-i", "pipe:0", "-pix_fmt", "bgr24",
-		"-s", strconv.Itoa(frameX)+"x"+strconv.Itoa(frameY), "-f", "rawvideo", "pipe:1")
-
-	// 取り込むときはIn,出すときはOut
-	ffmpegIn, _ := ffmpeg.StdinPipe()
-	ffmpegOut, _ := ffmpeg.StdoutPipe()
+	// mission pad(EDUのみ)はSDKのテキストコマンドで使う
+	if config.Config.MissionEnable {
+		droneManager.enableSDK(config.Config.MissionStatePort)
+	}
 
-	droneManager := &DroneManager{
-		Driver:               drone,
-		Speed:                DefaultSpeed,
-		patrolSem:            semaphore.NewWeighted(1),
-		patrolQuit:           make(chan bool),
-		isPatrolling:         false,
-		ffmpegIn:             ffmpegIn,
-		ffmpegOut:            ffmpegOut,
-		Stream:               mjpeg.NewStream(),
-		faceDetectTrackingOn: false,
-		isSnapShot:           false,
+	// WebRTCはffmpegを通さず、H.264のままブラウザへ流す
+	if config.Config.WebRTCEnable {
+		publisher, err := NewWebRTCPublisher(config.Config.WebRTCStunServer)
+		if err != nil {
+			log.Printf("action=NewDroneManager err=%s", err.Error())
+		} else {
+			droneManager.WebRTC = publisher
+		}
 	}
 
 	// Gobotのworkパターン
 	work := func() {
-		if err := ffmpeg.Start(); err != nil {
+		// 起動に失敗してもStreamVideoの中で再起動する
+		if err := decoder.Start(); err != nil {
 			log.Println(err)
-			return
 		}
 
 		// tello.ConnectedEvent : Droneを接続したら何をするか。
@@ -90,25 +99,50 @@ func NewDroneManager() *DroneManager {
 			log.Println("Connected")
 			// ビデオをオンにする
 			drone.StartVideo()
-			drone.SetVideoEncoderRate(tello.VideoBitRateAuto)
-			// カメラの露光レベル
-			drone.SetExposure(0)
+			// bitrate, 露光レベル, video modeは前回選んだ設定にする
+			droneManager.applyCameraSettings()
+			if droneManager.sdk != nil {
+				go droneManager.enableMissionPads(config.Config.MissionDirection)
+			}
 
 			//　100ミリセカンド毎にビデオのバイナリーを取り続ける。
 			gobot.Every(100*time.Millisecond, func() {
-				drone.StartVideo()
+				if droneManager.IsVideoStreaming() {
+					drone.StartVideo()
+				}
 			})
 
 			// とってきたInをOutでとりたい。Streamにわたす
 			droneManager.StreamVideo()
 		})
 
+		// ドローンの状態はTelemetryで返す
+		drone.On(tello.FlightDataEvent, func(data interface{}) {
+			droneManager.UpdateFlightData(data.(*tello.FlightData))
+		})
+		drone.On(tello.WifiDataEvent, func(data interface{}) {
+			droneManager.telemetry.updateWifiData(data.(*tello.WifiData))
+		})
+
 		// drone.OnのVideoFrameが入ってきたときに、ffmpegのInに書き込める
 		drone.On(tello.VideoFrameEvent, func(data interface{}) {
 			pkt := data.([]byte)
-			if _, err := ffmpegIn.Write(pkt); err != nil {
+			// StopVideoStreamの後に届いたパケットは捨てる
+			if !droneManager.IsVideoStreaming() {
+				return
+			}
+			ingressStart := time.Now()
+			droneManager.Metrics.PacketsIn.Inc()
+			droneManager.Metrics.BytesIn.Add(len(pkt))
+			droneManager.Metrics.PacketWritten(ingressStart)
+			if err := decoder.Write(pkt); err != nil {
 				log.Println(err)
 			}
+			if droneManager.WebRTC != nil {
+				droneManager.WebRTC.WritePacket(pkt)
+			}
+			droneManager.Restream.WritePacket(pkt)
+			droneManager.Metrics.Ingress.Since(ingressStart)
 		})
 	}
 	robot := gobot.NewRobot("tello", []gobot.Connection{}, []gobot.Device{drone}, work)
@@ -123,67 +157,127 @@ func NewDroneManager() *DroneManager {
 	return droneManager
 }
 
-func (d *DroneManager) Patrol() {
-	go func() {
-		// 1つだけ、ブロッキングなしでロックを取得できる。
-		// Acquire Goroutineで走らせるプログラムの数
-		isAcquire := d.patrolSem.TryAcquire(1)
-		// ２回目のパトロールでは!isAcquireでロックが取れない。
-		// Acquireできるのは１個だけだから。Loopを抜ける
-		if !isAcquire {
-			d.patrolQuit <- true
-			d.isPatrolling = false
-			return
-		}
-		// Loopの最後に１個 Releaseされ、isAcquireでロックを取得できる。
-		defer d.patrolSem.Release(1)
-		// いまからPatrolする
-		// statusの項目を増やしてパトロールの項目を返る。
-		// ３秒後にPatrolのStatusを変える。
-		d.isPatrolling = true
-		status := 0
-		t := time.NewTicker(3 * time.Second)
-		for {
-			select {
-			// C: ticker time
-			case <-t.C:
-				d.Hover()
-				switch status {
-				case 1:
-					d.Forward(d.Speed)
-				case 2:
-					d.Right(d.Speed)
-				case 3:
-					d.Backward(d.Speed)
-				case 4:
-					d.Left(d.Speed)
-				case 5:
-					status = 0
-				}
-				status++
-				// breakの方法.  d.patrolQuit channelがtrueで入って来た場合
-			case <-d.patrolQuit:
-				t.Stop()
-				d.Hover()
-				d.isPatrolling = false
-				return
-			}
+// ドローンに繋がない部分(コマンドキュー, 飛行モード, rc等)を作る。
+// ドローンと繋ぐのはNewDroneManagerで、テストでは偽物のDriverを渡してこれだけを使う
+func NewDroneManagerWithDriver(driver Driver) *DroneManager {
+	frame := NewFrameGeometry(config.Config.VideoWidth, config.Config.VideoHeight, config.Config.VideoPixFmt)
+	// ffmpegを走らせる。コマンドを打つ感じで。Pipe 0に書き込む
+	decoder, err := NewVideoDecoder(config.Config.VideoDecoder, frame)
+	if err != nil {
+		log.Printf("action=NewDroneManagerWithDriver decoder=%s err=%s use ffmpeg", config.Config.VideoDecoder, err.Error())
+		decoder, _ = NewVideoDecoder(DecoderFFmpeg, frame)
+	}
+
+	droneManager := &DroneManager{
+		Driver:      driver,
+		shakeSem:    semaphore.NewWeighted(1),
+		state:       newFlightStateMachine(),
+		arbiter:     newCommandArbiter(),
+		odometry:    newOdometry(config.Config.OdometryYawRate),
+		fence:       newGeofence(config.Config.GeofenceEnable, config.Config.GeofenceRadius, config.Config.GeofenceMaxHeight),
+		frame:       frame,
+		jpegQuality: config.Config.VideoJPEGQuality,
+		decoder:     decoder,
+		Stream:      mjpeg.NewStream(),
+		Metrics:     NewVideoMetrics(),
+		snapshotReq: make(chan chan struct{}, 1),
+		mission:     &missionController{},
+		camera:      newCameraSettings(config.Config.CameraStateFile),
+		Restream: NewRestreamer(config.Config.RestreamHLSDir, config.Config.RestreamRTSPURL,
+			config.Config.RestreamWidth, config.Config.RestreamHeight),
+	}
+
+	droneManager.SetSpeed(DefaultSpeed)
+	// rcの回転もodometryに記録する
+	droneManager.rc = newRCController(time.Duration(config.Config.RCTimeoutMs)*time.Millisecond,
+		config.Config.RCSmoothing, droneManager.setVector)
+	droneManager.patrol = newPatrolController(droneManager.auto(), droneManager.Speed, patrolInterval)
+
+	go droneManager.arbiter.run()
+	go droneManager.rc.run()
+	go droneManager.watchState()
+	// Patrolから別のモードになったら、Patrolの動作を止める。Hoverが終わるまで待つので、
+	// 遷移した後のコマンド(Land等)より前にpatrolのコマンドが全部終わる
+	droneManager.OnTransition(func(e StateEvent) {
+		// モードが変わったら、移動の後に予約したHoverはもう要らない
+		droneManager.hoverTimer.cancel()
+		switch e.From {
+		case ModePatrol:
+			droneManager.patrol.stop()
+		case ModeMission:
+			droneManager.mission.stop()
 		}
-	}()
+	})
+
+	return droneManager
+}
+
+// FlightDataEventで届いたテレメトリから、飛行モード, 推定の位置, フェンスを更新する
+func (d *DroneManager) UpdateFlightData(fd *tello.FlightData) {
+	d.telemetry.updateFlightData(fd)
+	d.updateStateFromTelemetry()
+	d.odometry.update(d.telemetry.get(), time.Now())
+	d.enforceGeofence()
 }
 
-func (d *DroneManager) StartPatrol() {
-	// 0 valueは False
-	if !d.isPatrolling {
-		d.Patrol()
+// ManualかTrackingの時だけPatrolにできる
+func (d *DroneManager) StartPatrol() error {
+	if err := d.checkArmed(); err != nil {
+		return err
 	}
+	if _, err := d.state.transition(ModePatrol, "start patrol", ModeManual, ModeTracking); err != nil {
+		return err
+	}
+	d.patrol.start()
+	return nil
 }
 
+// Manualに戻す。patrolの最後のHoverが終わってから返る
 func (d *DroneManager) StopPatrol() {
+	d.state.transition(ModeManual, "stop patrol", ModePatrol)
+}
 
-	if d.isPatrolling {
-		d.Patrol()
+// 左右に揺れる。amplitude: 左右に動くスピード, count: 往復の回数, interval: 片道の時間
+// パイロットの操作なのでManualの優先度で送る。飛んでいる時(Manualか自動のモード)だけできる。
+// 最初の1回はここで送って、取り消されたらエラーを返す。Semaphoreで１つだけ実行する
+func (d *DroneManager) Shake(amplitude, count int, interval time.Duration) error {
+	if err := d.checkArmed(); err != nil {
+		return err
+	}
+	if mode := d.FlightMode(); mode != ModeManual && !mode.Autonomous() {
+		return ErrShakeNotFlying
 	}
+	if !d.shakeSem.TryAcquire(1) {
+		return ErrAlreadyShaking
+	}
+	if err := d.Left(amplitude); err != nil {
+		d.shakeSem.Release(1)
+		return err
+	}
+	go func() {
+		defer d.shakeSem.Release(1)
+		for i := 0; i < count; i++ {
+			// 着陸や緊急停止、patrol等でManualでなくなったら、そこでやめる
+			if i > 0 {
+				time.Sleep(interval)
+				if d.FlightMode() != ModeManual || d.Left(amplitude) != nil {
+					return
+				}
+			}
+			time.Sleep(interval)
+			if d.FlightMode() != ModeManual || d.Right(amplitude) != nil {
+				return
+			}
+		}
+		time.Sleep(interval)
+		if d.FlightMode() == ModeManual {
+			d.move(PriorityManual, "hover", func() error {
+				d.hover()
+				return nil
+			})
+		}
+	}()
+	return nil
 }
 
 func (d *DroneManager) StreamVideo() {
@@ -196,115 +290,202 @@ func (d *DroneManager) StreamVideo() {
 			return
 		}
 
+		// 顔検出は別のGoroutineで走らせて、ストリームを止めない
+		detector := newFaceDetector(d.Metrics, d.trackFaces)
+		go detector.Run(&classifier)
+		defer close(detector.frames)
+
 		blue := color.RGBA{0, 0, 255, 0}
+		green := color.RGBA{0, 255, 0, 0}
+		wasTracking := false
 
 		for {
-			buf := make([]byte, frameSize)
-			if _, err := io.ReadFull(d.ffmpegOut, buf); err != nil {
+			buf := make([]byte, d.frame.Size)
+			if err := d.decoder.ReadFrame(buf); err != nil {
 				log.Println(err)
+				d.Metrics.DecodeErrors.Inc()
+				continue
 			}
+			d.Metrics.FrameDecoded(time.Now())
 			// とってきたByte配列をImageに変換
-			img, _ := gocv.NewMatFromBytes(frameY, frameX, gocv.MatTypeCV8UC3, buf)
+			img, _ := gocv.NewMatFromBytes(d.frame.Height, d.frame.Width, d.frame.MatType, buf)
 
 			if img.Empty() {
 				continue
 			}
 
-			if d.faceDetectTrackingOn {
-				d.StopPatrol()
-				rects := classifier.DetectMultiScale(img)
-				log.Printf("found %d faces\n", len(rects))
+			// PatrolとTrackingは同時にならないので、ここでStopPatrolしなくていい
+			tracking := d.FlightMode() == ModeTracking
+			if tracking {
+				detector.Submit(img)
 				// index は省く
-
-				if len(rects) == 0 {
-					d.Hover()
-				}
-				for _, r := range rects {
+				for _, r := range detector.Boxes(time.Now()) {
 					gocv.Rectangle(&img, r, blue, 3)
 					// Humanの位置
 					pt := image.Pt(r.Max.X, r.Min.Y-5)
 					gocv.PutText(&img, "Human", pt, gocv.FontHersheyPlain, 1.2, blue, 2)
-
-					faceWidth := r.Max.X - r.Min.X
-					faceHight := r.Max.Y - r.Min.Y
-					// X 20 50 => 20 + (30/2) = 35
-					faceCenterX := r.Min.X + (faceWidth / 2)
-					faceCenterY := r.Min.Y + (faceHight / 2)
-					faceArea := faceWidth * faceHight
-					// 160 - 35 = 125
-					diffX := frameCenterX - faceCenterX
-					diffY := frameCenterY - faceCenterY
-					percentF := math.Round(float64(faceArea) / float64(frameArea) * 100)
-
-					move := false
-					if diffX < -20 {
-						d.Right(15)
-						move = true
-					}
-					if diffX > 20 {
-						d.Left(15)
-						move = true
-					}
-
-					if diffY < -30 {
-						d.Down(25)
-						move = true
-					}
-
-					if diffY > 30 {
-						d.Up(25)
-						move = true
-					}
-					if percentF > 7.0 {
-						d.Backward(10)
-						move = true
-					}
-					if percentF < 0.9 {
-						d.Forward(10)
-						move = true
-					}
-					if !move {
-						d.Hover()
-					}
-					break
 				}
+			} else if wasTracking {
+				detector.Reset()
+			}
+			wasTracking = tracking
+
+			// HUD: 左上に処理時間を表示する
+			if d.showMetricsHUD.Load() {
+				gocv.PutText(&img, d.Metrics.HUDText(), image.Pt(5, 15), gocv.FontHersheyPlain, 1, green, 1)
 			}
 
-			jpegBuf, _ := gocv.IMEncode(".jpg", img)
+			encodeStart := time.Now()
+			jpegBuf, _ := gocv.IMEncodeWithParams(".jpg", img, []int{int(gocv.IMWriteJpegQuality), d.jpegQuality})
+			d.Metrics.Encode.Since(encodeStart)
+			img.Close()
 
-			if d.isSnapShot {
+			// TakeSnapShotから頼まれていたら保存して、doneを閉じて知らせる
+			select {
+			case done := <-d.snapshotReq:
 				backupFileName := snapshotsFolder + time.Now().Format(time.RFC3339) + ".jpg"
 				ioutil.WriteFile(backupFileName, jpegBuf, 0644)
 
 				// snapshot.jpgは上書きされるから、↑で保存する。
 				snapshotFileName := snapshotsFolder + "snapshot.jpg"
 				ioutil.WriteFile(snapshotFileName, jpegBuf, 0644)
-				d.isSnapShot = false
+				close(done)
+			default:
 			}
 
+			publishStart := time.Now()
 			d.Stream.UpdateJPEG(jpegBuf)
+			d.Metrics.Publish.Since(publishStart)
+			d.Metrics.FramesPublished.Inc()
+			d.Metrics.PublishRate.Mark()
 		}
 	}(d)
 }
 
+// 顔検出のGoroutineから検出の度に呼ばれる。最初の顔がフレームの中心に来るように動く
+func (d *DroneManager) trackFaces(rects []image.Rectangle) {
+	if d.FlightMode() != ModeTracking {
+		return
+	}
+	log.Printf("found %d faces\n", len(rects))
+	if len(rects) == 0 {
+		d.auto().Hover()
+		return
+	}
+
+	r := rects[0]
+	faceWidth := r.Max.X - r.Min.X
+	faceHight := r.Max.Y - r.Min.Y
+	// X 20 50 => 20 + (30/2) = 35
+	faceCenterX := r.Min.X + (faceWidth / 2)
+	faceCenterY := r.Min.Y + (faceHight / 2)
+	faceArea := faceWidth * faceHight
+	// 160 - 35 = 125
+	diffX := d.frame.CenterX - faceCenterX
+	diffY := d.frame.CenterY - faceCenterY
+	percentF := math.Round(float64(faceArea) / float64(d.frame.Area) * 100)
+
+	move := false
+	if diffX < -20 {
+		d.auto().Right(15)
+		move = true
+	}
+	if diffX > 20 {
+		d.auto().Left(15)
+		move = true
+	}
+
+	if diffY < -30 {
+		d.auto().Down(25)
+		move = true
+	}
+
+	if diffY > 30 {
+		d.auto().Up(25)
+		move = true
+	}
+	if percentF > 7.0 {
+		d.auto().Backward(10)
+		move = true
+	}
+	if percentF < 0.9 {
+		d.auto().Forward(10)
+		move = true
+	}
+	if !move {
+		d.auto().Hover()
+	}
+}
+
+// 推定の位置と向きも入れて返す
+func (d *DroneManager) Telemetry() Telemetry {
+	t := d.telemetry.get()
+	t.Odometry = d.Odometry()
+	if pad, ok := d.MissionPad(); ok {
+		t.MissionPad = &pad
+	}
+	return t
+}
+
+func (d *DroneManager) IsPatrolling() bool {
+	return d.FlightMode() == ModePatrol
+}
+
+func (d *DroneManager) IsFaceDetectTracking() bool {
+	return d.FlightMode() == ModeTracking
+}
+
+func (d *DroneManager) DecoderHealth() DecoderHealth {
+	return d.decoder.Health()
+}
+
 // contextを使用し、キャンセル条件を書く
+// StreamVideoが次のフレームを保存してdoneを閉じるまで待つ
 func (d *DroneManager) TakeSnapShot() {
-	d.isSnapShot = true
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
-	for{
-		if !d.isSnapShot || ctx.Err() !=nil{
-			break
-		}
+	done := make(chan struct{})
+	select {
+	case d.snapshotReq <- done:
+	case <-ctx.Done():
+		return
 	}
-	d.isSnapShot = false
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// ManualかPatrolの時だけTrackingにできる
+func (d *DroneManager) EnableFaceDetectTracking() error {
+	if err := d.checkArmed(); err != nil {
+		return err
+	}
+	_, err := d.state.transition(ModeTracking, "start face tracking", ModeManual, ModePatrol)
+	return err
+}
+
+// 手動のコマンドとpatrolのスピード。
+// HTTPのハンドラーが書き換えて、patrolのGoroutineやキーボードの入力が読むのでatomicにする
+func (d *DroneManager) Speed() int {
+	return int(d.speed.Load())
 }
 
-func (d *DroneManager) EnableFaceDetectTracking() {
-	d.faceDetectTrackingOn = true
+func (d *DroneManager) SetSpeed(speed int) {
+	d.speed.Store(int32(speed))
+}
+
+// HTTPのハンドラーが書き換えて、StreamVideoのGoroutineがフレーム毎に読むのでatomicにする
+func (d *DroneManager) EnableMetricsHUD() {
+	d.showMetricsHUD.Store(true)
+}
+
+func (d *DroneManager) DisableMetricsHUD() {
+	d.showMetricsHUD.Store(false)
 }
 
 func (d *DroneManager) DisableFaceDetectTracking() {
-	d.faceDetectTrackingOn = false
-	d.Hover()
+	if from, err := d.state.transition(ModeManual, "stop face tracking", ModeTracking); err == nil && from == ModeTracking {
+		d.Hover()
+	}
 }
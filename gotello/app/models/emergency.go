@@ -0,0 +1,85 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+var ErrEmergencyLatched = errors.New("emergency stop is latched, re-arm before flying")
+
+// 緊急停止の状態。一度止めたらRearmするまで離陸も移動もできない
+// 飛行モードがEmergencyの間がラッチしている状態
+type EmergencyState struct {
+	Latched   bool      `json:"latched"`
+	LatchedAt time.Time `json:"latchedAt"`
+}
+
+// "command"の返事(ok)を待つ時間。返事が無くてもemergencyは送る
+const emergencyReplyTimeout = 300 * time.Millisecond
+
+// gobotのDriverにはモーターを止めるコマンドが無いので、SDKのテキストコマンドを直接送る。
+// SDKモードになる前のemergencyは無視されるので、"command"のokを少しだけ待ってから"emergency"を送る。
+// ソケットは最初の緊急停止で作って使い回す。missionの返事と混ざらないように別のソケットにする
+func (d *DroneManager) sendEmergency() error {
+	d.emergencyMu.Lock()
+	defer d.emergencyMu.Unlock()
+	if d.emergencySDK == nil {
+		c, err := newSDKClient(telloAddr)
+		if err != nil {
+			return err
+		}
+		d.emergencySDK = c
+	}
+	if err := d.emergencySDK.do(context.Background(), "command", emergencyReplyTimeout); err != nil {
+		log.Printf("action=sendEmergency command=command err=%s", err.Error())
+	}
+	return d.emergencySDK.write("emergency")
+}
+
+// 緊急停止。モードの遷移(patrolの終わりを待つ等)より先に、待っているコマンドとrcを止めてモーターを止める。
+// その後Emergencyのモードにして、Rearmするまで他のコマンドを受け付けない
+// emergencyが届かなかった場合のために、Landも送る
+func (d *DroneManager) Emergency() error {
+	// コマンドキューは通さない。待っているコマンドは全部取り消す
+	d.arbiter.preemptAll()
+	d.rc.reset()
+	err := d.sendEmergency()
+	if err != nil {
+		log.Printf("action=Emergency err=%s", err.Error())
+	}
+
+	d.state.transition(ModeEmergency, "emergency stop")
+	// 遷移する前に届いたrcの値を残さない
+	d.rc.reset()
+	if landErr := d.Driver.Land(); landErr != nil && err == nil {
+		err = landErr
+	}
+	return err
+}
+
+// 緊急停止を解除して、また飛べるようにする。まだ飛んでいればManualにする
+func (d *DroneManager) Rearm() error {
+	to := ModeGrounded
+	if d.telemetry.get().Flying {
+		to = ModeManual
+	}
+	_, err := d.state.transition(to, "rearm", ModeEmergency)
+	return err
+}
+
+func (d *DroneManager) EmergencyState() EmergencyState {
+	mode, since := d.state.current()
+	if mode != ModeEmergency {
+		return EmergencyState{}
+	}
+	return EmergencyState{Latched: true, LatchedAt: since}
+}
+
+func (d *DroneManager) checkArmed() error {
+	if d.FlightMode() == ModeEmergency {
+		return ErrEmergencyLatched
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package models
+
+import (
+	"fmt"
+	"math"
+)
+
+// Gamepad APIのstandard mappingの番号
+// axes: 0 左スティックX, 1 左スティックY, 2 右スティックX, 3 右スティックY (上が-1)
+// buttons: 0 A, 1 B, 2 X, 3 Y, 4 LB, 5 RB, 12~15 十字キー上下左右
+const (
+	maxGamepadAxes    = 16
+	maxGamepadButtons = 32
+)
+
+var gamepadSticks = []string{"roll", "pitch", "throttle", "yaw"}
+
+// Axis: gamepadのaxesの番号, Invert: 向きを逆にする
+// Deadzone: この値より小さい傾きは0にする(0~0.9)
+// Expo: 0なら直線、1に近いほど中心付近が緩やかになる(0~1)
+type AxisMapping struct {
+	Axis     int     `json:"axis"`
+	Invert   bool    `json:"invert"`
+	Deadzone float64 `json:"deadzone"`
+	Expo     float64 `json:"expo"`
+}
+
+// Axesのキーは roll, pitch, throttle, yaw
+// Buttonsはボタンの番号と、押した時に実行するコマンド(/api/command/のcommand)
+type GamepadProfile struct {
+	Axes    map[string]AxisMapping `json:"axes"`
+	Buttons map[int]string         `json:"buttons"`
+}
+
+// Xbox padでMode 2: 左スティックでthrottleとyaw、右スティックでpitchとroll
+func DefaultGamepadProfile() *GamepadProfile {
+	return &GamepadProfile{
+		Axes: map[string]AxisMapping{
+			"roll":     {Axis: 2, Deadzone: 0.1, Expo: 0.3},
+			"pitch":    {Axis: 3, Invert: true, Deadzone: 0.1, Expo: 0.3},
+			"throttle": {Axis: 1, Invert: true, Deadzone: 0.1},
+			"yaw":      {Axis: 0, Deadzone: 0.1, Expo: 0.3},
+		},
+		Buttons: map[int]string{
+			0:  "takeOff",
+			1:  "land",
+			2:  "hover",
+			3:  "snapshot",
+			12: "frontFlip",
+			13: "backFlip",
+			14: "leftFlip",
+			15: "rightFlip",
+		},
+	}
+}
+
+// knownCommandはボタンに割り当てられるコマンドかどうか
+func (g *GamepadProfile) Validate(knownCommand func(string) bool) error {
+	for name, m := range g.Axes {
+		if !contains(gamepadSticks, name) {
+			return fmt.Errorf("axes: unknown stick %q", name)
+		}
+		if m.Axis < 0 || m.Axis >= maxGamepadAxes {
+			return fmt.Errorf("axes.%s.axis must be between 0 and %d", name, maxGamepadAxes-1)
+		}
+		if m.Deadzone < 0 || m.Deadzone > 0.9 {
+			return fmt.Errorf("axes.%s.deadzone must be between 0 and 0.9", name)
+		}
+		if m.Expo < 0 || m.Expo > 1 {
+			return fmt.Errorf("axes.%s.expo must be between 0 and 1", name)
+		}
+	}
+	for button, command := range g.Buttons {
+		if button < 0 || button >= maxGamepadButtons {
+			return fmt.Errorf("buttons: button must be between 0 and %d", maxGamepadButtons-1)
+		}
+		if !knownCommand(command) {
+			return fmt.Errorf("buttons.%d: unknown command %q", button, command)
+		}
+	}
+	return nil
+}
+
+// gamepadのaxes(-1~1)をSticks(-100~100)にする。割り当てていないstickは0
+func (g *GamepadProfile) Sticks(axes []float64) Sticks {
+	value := func(name string) int {
+		m, ok := g.Axes[name]
+		if !ok || m.Axis >= len(axes) {
+			return 0
+		}
+		return int(math.Round(m.apply(axes[m.Axis]) * rcMaxStick))
+	}
+	return Sticks{
+		Roll:     value("roll"),
+		Pitch:    value("pitch"),
+		Throttle: value("throttle"),
+		Yaw:      value("yaw"),
+	}
+}
+
+// deadzoneの外側を0~1に広げてから、expoのカーブをかける
+func (m AxisMapping) apply(x float64) float64 {
+	x = math.Max(-1, math.Min(1, x))
+	if m.Invert {
+		x = -x
+	}
+	abs := math.Abs(x)
+	if abs <= m.Deadzone {
+		return 0
+	}
+	abs = (abs - m.Deadzone) / (1 - m.Deadzone)
+	abs = (1-m.Expo)*abs + m.Expo*abs*abs*abs
+	return math.Copysign(abs, x)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
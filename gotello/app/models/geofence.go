@@ -0,0 +1,175 @@
+package models
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrGeofence = errors.New("command would leave the geofence")
+
+const (
+	// 今の速度でこの時間進んだ位置がフェンスの外なら止める
+	geofenceLookahead = 500 * time.Millisecond
+	// 同じ対処を繰り返す間隔
+	geofenceRepeat = time.Second
+	// 高さの上限を超えた時に下がる速さ
+	geofenceDescendSpeed = 20
+)
+
+// GET /api/v1/geofence
+type GeofenceStatus struct {
+	Enabled   bool     `json:"enabled"`
+	Position  Position `json:"position"`
+	Velocity  Position `json:"velocity"`
+	Distance  float64  `json:"distance"`
+	Radius    float64  `json:"radius"`
+	MaxHeight float64  `json:"maxHeight"`
+	Breached  bool     `json:"breached"`
+}
+
+// フェンスの外に出そうな時にドローンにさせること
+type fenceAction int
+
+const (
+	fenceNone fenceAction = iota
+	fenceHover
+	fenceDescend
+)
+
+// 位置はodometryの推定を使う。推定の向きは誤差が大きいので、前後左右のコマンドが
+// どちらに進むかは判断しない。水平方向は、外に向かって動いていることを速度で見つけて止める
+type geofence struct {
+	mu        sync.Mutex
+	enabled   bool
+	radius    float64
+	maxHeight float64
+	pos       Position
+	vel       Position
+	action    fenceAction
+	actedAt   time.Time
+}
+
+func newGeofence(enabled bool, radius, maxHeight float64) *geofence {
+	return &geofence{enabled: enabled, radius: radius, maxHeight: maxHeight}
+}
+
+// 今の速度でgeofenceLookahead進んだ位置
+func (f *geofence) aheadLocked() Position {
+	s := geofenceLookahead.Seconds()
+	return Position{X: f.pos.X + f.vel.X*s, Y: f.pos.Y + f.vel.Y*s, Z: f.pos.Z + f.vel.Z*s}
+}
+
+// 外に出て、さらに外に向かって動いている
+func (f *geofence) outwardLocked() bool {
+	return f.aheadLocked().horizontal() > f.radius && f.vel.X*f.pos.X+f.vel.Y*f.pos.Y > 0
+}
+
+// FlightDataEventの度にodometryの推定を受け取って、必要な対処を返す。
+// 同じ対処はgeofenceRepeatの間は返さない。上限より下に戻ったらHoverで下降を止める
+func (f *geofence) update(o Odometry, flying bool, now time.Time) fenceAction {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pos, f.vel = o.Position, o.Velocity
+	if !flying || !f.enabled {
+		f.action = fenceNone
+		return fenceNone
+	}
+
+	action := fenceNone
+	switch {
+	case f.pos.Z > f.maxHeight:
+		action = fenceDescend
+	case f.outwardLocked():
+		action = fenceHover
+	case f.action == fenceDescend:
+		action = fenceHover
+	}
+	if action == fenceNone {
+		f.action = fenceNone
+		return fenceNone
+	}
+	if action == f.action && now.Sub(f.actedAt) < geofenceRepeat {
+		return fenceNone
+	}
+	f.action, f.actedAt = action, now
+	return action
+}
+
+// キューに入れる前にコマンドを確認する。上限の高さでは上昇させず、
+// フェンスの外に向かう時は自動のコマンドで水平に動かさない
+func (f *geofence) check(priority CommandPriority, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.enabled {
+		return nil
+	}
+	switch name {
+	case "up":
+		if f.pos.Z >= f.maxHeight {
+			return ErrGeofence
+		}
+	case "forward", "backward", "left", "right":
+		if priority == PriorityAutonomous && f.aheadLocked().horizontal() > f.radius {
+			return ErrGeofence
+		}
+	}
+	return nil
+}
+
+// rcのスティックを制限する。上限の高さでは上昇を0に、外に向かって動いている間は水平を0にする
+func (f *geofence) limitSticks(s Sticks) Sticks {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.enabled {
+		return s
+	}
+	if f.pos.Z >= f.maxHeight && s.Throttle > 0 {
+		s.Throttle = 0
+	}
+	if f.outwardLocked() {
+		s.Roll, s.Pitch = 0, 0
+	}
+	return s
+}
+
+func (f *geofence) status() GeofenceStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	distance := f.pos.horizontal()
+	return GeofenceStatus{
+		Enabled:   f.enabled,
+		Position:  f.pos,
+		Velocity:  f.vel,
+		Distance:  distance,
+		Radius:    f.radius,
+		MaxHeight: f.maxHeight,
+		Breached:  f.enabled && (distance > f.radius || f.pos.Z > f.maxHeight),
+	}
+}
+
+func (d *DroneManager) Geofence() GeofenceStatus {
+	return d.fence.status()
+}
+
+// フェンスから出そうなら、自動のモードをやめてHoverか下降をさせる。
+// パイロットの操作より優先するので、PriorityGeofenceでキューに入れる
+func (d *DroneManager) enforceGeofence() {
+	now := time.Now()
+	action := d.fence.update(d.odometry.estimate(now), d.telemetry.get().Flying, now)
+	// 緊急停止中はモーターが止まっているので何もしない
+	if action == fenceNone || d.checkArmed() != nil {
+		return
+	}
+	d.state.transition(ModeManual, "geofence", autonomousModes...)
+	d.rc.reset()
+	fn := func() error {
+		d.hover()
+		return nil
+	}
+	if action == fenceDescend {
+		fn = func() error { return d.Driver.Down(geofenceDescendSpeed) }
+	}
+	// FlightDataEventのGoroutineを止めないように待たない
+	go d.arbiter.do(PriorityGeofence, "geofence", fn)
+}
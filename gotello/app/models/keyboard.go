@@ -0,0 +1,87 @@
+package models
+
+import "fmt"
+
+// 押している間だけ動くキーの動作。値はSticksのどの軸をどちらに動かすか
+var keyboardMoves = map[string]struct {
+	axis int
+	sign int
+}{
+	"right":            {0, 1},
+	"left":             {0, -1},
+	"forward":          {1, 1},
+	"backward":         {1, -1},
+	"up":               {2, 1},
+	"down":             {2, -1},
+	"clockwise":        {3, 1},
+	"counterClockwise": {3, -1},
+}
+
+// Keysのキーはブラウザの KeyboardEvent.code (KeyW, ArrowUp, Space等)
+// 値は移動(forward, up, clockwise等)か、押した時に1回実行するコマンド(/api/command/のcommand)
+type KeyboardProfile struct {
+	Keys map[string]string `json:"keys"`
+}
+
+// WASDで前後左右、矢印の上下で上昇下降、Q/Eと矢印の左右で回転、Spaceで離陸/着陸、Escで緊急停止
+func DefaultKeyboardProfile() *KeyboardProfile {
+	return &KeyboardProfile{
+		Keys: map[string]string{
+			"KeyW":       "forward",
+			"KeyS":       "backward",
+			"KeyA":       "left",
+			"KeyD":       "right",
+			"ArrowUp":    "up",
+			"ArrowDown":  "down",
+			"ArrowLeft":  "counterClockwise",
+			"ArrowRight": "clockwise",
+			"KeyQ":       "counterClockwise",
+			"KeyE":       "clockwise",
+			"Space":      "takeOffLand",
+			"Escape":     "emergency",
+		},
+	}
+}
+
+func (k *KeyboardProfile) Validate(knownCommand func(string) bool) error {
+	for key, action := range k.Keys {
+		if key == "" || len(key) > 32 {
+			return fmt.Errorf("keys: key must be a KeyboardEvent.code")
+		}
+		if _, ok := keyboardMoves[action]; !ok && !knownCommand(action) {
+			return fmt.Errorf("keys.%s: unknown action %q", key, action)
+		}
+	}
+	return nil
+}
+
+// 押しているキーから移動のスティックを作る。反対向きのキーを同時に押すと0になる
+func (k *KeyboardProfile) Sticks(held []string, speed int) Sticks {
+	if speed > rcMaxStick {
+		speed = rcMaxStick
+	}
+	var axes [4]int
+	seen := map[string]bool{}
+	for _, key := range held {
+		move, ok := keyboardMoves[k.Keys[key]]
+		// 同じ動作に2つのキーが割り当てられていても2倍にしない
+		if !ok || seen[k.Keys[key]] {
+			continue
+		}
+		seen[k.Keys[key]] = true
+		axes[move.axis] += move.sign * speed
+	}
+	return Sticks{Roll: axes[0], Pitch: axes[1], Throttle: axes[2], Yaw: axes[3]}
+}
+
+// 移動ではない、1回だけ実行するコマンドかどうか
+func (k *KeyboardProfile) Command(key string) (string, bool) {
+	action, ok := k.Keys[key]
+	if !ok {
+		return "", false
+	}
+	if _, move := keyboardMoves[action]; move {
+		return "", false
+	}
+	return action, true
+}
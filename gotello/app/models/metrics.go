@@ -0,0 +1,216 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 処理時間のbucket(秒)。30fpsなら1フレーム33ms
+var defaultLatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.02, 0.033, 0.05, 0.1, 0.25, 0.5, 1}
+
+type Counter struct {
+	value uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(n int) {
+	atomic.AddUint64(&c.value, uint64(n))
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// 処理時間のヒストグラム。countsは各bucketの上限以下の数（累積しない）
+// 最後の要素は+Inf
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+	last    time.Duration
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	seconds := d.Seconds()
+	i := 0
+	for i < len(h.buckets) && seconds > h.buckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+	h.last = d
+}
+
+// 開始時間を渡すと経過時間を記録する
+// defer h.Since(time.Now()) のように使う
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start))
+}
+
+// Cumulativeは各bucketの上限以下の累積数。Prometheusのle="..."と同じ
+type HistogramSnapshot struct {
+	Buckets    []float64 `json:"buckets"`
+	Cumulative []uint64  `json:"cumulative"`
+	Count      uint64    `json:"count"`
+	Sum        float64   `json:"sum"`
+	MeanMs     float64   `json:"meanMs"`
+	LastMs     float64   `json:"lastMs"`
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	snapshot := HistogramSnapshot{
+		Buckets:    h.buckets,
+		Cumulative: make([]uint64, len(h.buckets)),
+		Count:      h.count,
+		Sum:        h.sum,
+		LastMs:     float64(h.last) / float64(time.Millisecond),
+	}
+	var total uint64
+	for i := range h.buckets {
+		total += h.counts[i]
+		snapshot.Cumulative[i] = total
+	}
+	if h.count > 0 {
+		snapshot.MeanMs = h.sum / float64(h.count) * 1000
+	}
+	return snapshot
+}
+
+// 1秒毎に回数を数えて、秒間の回数を出す
+type RateMeter struct {
+	mu     sync.Mutex
+	count  int
+	start  time.Time
+	rate   float64
+	lastAt time.Time
+}
+
+func (m *RateMeter) Mark() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.count++
+	m.lastAt = now
+	if m.start.IsZero() {
+		m.start = now
+	}
+	if elapsed := now.Sub(m.start); elapsed >= time.Second {
+		m.rate = float64(m.count) / elapsed.Seconds()
+		m.count = 0
+		m.start = now
+	}
+}
+
+// 2秒以上Markされていなければ止まっているとみなす
+func (m *RateMeter) Rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Since(m.lastAt) > 2*time.Second {
+		return 0
+	}
+	return m.rate
+}
+
+// ビデオの各段階(パケット受信, デコード, 顔検出, JPEGエンコード, MJPEG配信)の回数と処理時間。
+// ingressはVideoFrameEventの1パケットの処理(デコーダー, WebRTC, 再配信への書き込み)
+type VideoMetrics struct {
+	PacketsIn       Counter
+	BytesIn         Counter
+	FramesDecoded   Counter
+	DecodeErrors    Counter
+	FramesDetected  Counter
+	FramesPublished Counter
+	Ingress         *Histogram
+	Decode          *Histogram
+	Detect          *Histogram
+	Encode          *Histogram
+	Publish         *Histogram
+	PublishRate     RateMeter
+	decodeMu        sync.Mutex
+	decodeSince     time.Time
+}
+
+func NewVideoMetrics() *VideoMetrics {
+	return &VideoMetrics{
+		Ingress: NewHistogram(defaultLatencyBuckets),
+		Decode:  NewHistogram(defaultLatencyBuckets),
+		Detect:  NewHistogram(defaultLatencyBuckets),
+		Encode:  NewHistogram(defaultLatencyBuckets),
+		Publish: NewHistogram(defaultLatencyBuckets),
+	}
+}
+
+// デコーダーにパケットを書き込む前に呼ぶ。
+// デコードの時間は、前のフレームが出た後に最初に書き込んだパケットから、次のフレームが出るまで。
+// ReadFrameがパケットを待っている時間は入れない
+func (m *VideoMetrics) PacketWritten(at time.Time) {
+	m.decodeMu.Lock()
+	defer m.decodeMu.Unlock()
+	if m.decodeSince.IsZero() {
+		m.decodeSince = at
+	}
+}
+
+// ReadFrameがフレームを返した時に呼ぶ
+func (m *VideoMetrics) FrameDecoded(at time.Time) {
+	m.FramesDecoded.Inc()
+	m.decodeMu.Lock()
+	since := m.decodeSince
+	m.decodeSince = time.Time{}
+	m.decodeMu.Unlock()
+	if !since.IsZero() {
+		m.Decode.Observe(at.Sub(since))
+	}
+}
+
+type VideoMetricsSnapshot struct {
+	PacketsIn       uint64                       `json:"packetsIn"`
+	BytesIn         uint64                       `json:"bytesIn"`
+	FramesDecoded   uint64                       `json:"framesDecoded"`
+	DecodeErrors    uint64                       `json:"decodeErrors"`
+	FramesDetected  uint64                       `json:"framesDetected"`
+	FramesPublished uint64                       `json:"framesPublished"`
+	PublishFPS      float64                      `json:"publishFps"`
+	Stages          map[string]HistogramSnapshot `json:"stages"`
+}
+
+func (m *VideoMetrics) Snapshot() VideoMetricsSnapshot {
+	return VideoMetricsSnapshot{
+		PacketsIn:       m.PacketsIn.Value(),
+		BytesIn:         m.BytesIn.Value(),
+		FramesDecoded:   m.FramesDecoded.Value(),
+		DecodeErrors:    m.DecodeErrors.Value(),
+		FramesDetected:  m.FramesDetected.Value(),
+		FramesPublished: m.FramesPublished.Value(),
+		PublishFPS:      m.PublishRate.Rate(),
+		Stages: map[string]HistogramSnapshot{
+			"ingress": m.Ingress.Snapshot(),
+			"decode":  m.Decode.Snapshot(),
+			"detect":  m.Detect.Snapshot(),
+			"encode":  m.Encode.Snapshot(),
+			"publish": m.Publish.Snapshot(),
+		},
+	}
+}
+
+// HUDに表示する1行
+func (m *VideoMetrics) HUDText() string {
+	return fmt.Sprintf("%.1ffps dec %.1fms det %.1fms enc %.1fms",
+		m.PublishRate.Rate(), m.Decode.Snapshot().LastMs, m.Detect.Snapshot().LastMs, m.Encode.Snapshot().LastMs)
+}
@@ -0,0 +1,319 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrMissionPadsDisabled = errors.New("mission pads are disabled, enable [mission] in config.ini")
+
+const (
+	// goとjumpは移動が終わってから返事が来るので長めに待つ
+	missionStepTimeout = 30 * time.Second
+	maxMissionSteps    = 50
+)
+
+// 見えているmission pad(EDUのみ)。IDは1-8で、見えていなければ-1
+// X, Y, Zはpadからの位置(cm)、Yawはpadに対する向き(度)
+type MissionPad struct {
+	ID        int       `json:"id"`
+	Detected  bool      `json:"detected"`
+	X         int       `json:"x"`
+	Y         int       `json:"y"`
+	Z         int       `json:"z"`
+	Yaw       int       `json:"yaw"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type padStore struct {
+	mu  sync.RWMutex
+	pad MissionPad
+}
+
+// SDKの状態のmid, x, y, z, mpry(pitch,roll,yaw)から作る
+func (p *padStore) update(state map[string]string) {
+	pad := MissionPad{ID: stateInt(state, "mid"), UpdatedAt: time.Now()}
+	if pad.ID > 0 {
+		pad.Detected = true
+		pad.X, pad.Y, pad.Z = stateInt(state, "x"), stateInt(state, "y"), stateInt(state, "z")
+		if mpry := strings.Split(state["mpry"], ","); len(mpry) == 3 {
+			pad.Yaw, _ = strconv.Atoi(mpry[2])
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pad = pad
+}
+
+func (p *padStore) get() MissionPad {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.pad
+}
+
+// padを基準にした位置へ飛ぶ1ステップ。X, Y, Zはcm, Speedはcm/s
+// JumpToが0でなければjump: Padの上の(X, Y, Z)へ飛び、JumpToのpadを見つけてYawの向きにする
+type MissionStep struct {
+	Pad    int `json:"pad"`
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Z      int `json:"z"`
+	Speed  int `json:"speed"`
+	JumpTo int `json:"jumpTo,omitempty"`
+	Yaw    int `json:"yaw,omitempty"`
+}
+
+// SDK 2.0の範囲。x, yは-500から500, zは0から500, speedは10から100。
+// x, y, zが全部-20から20の中にはできない
+func (s MissionStep) validate() error {
+	switch {
+	case s.Pad < 1 || s.Pad > 8:
+		return fmt.Errorf("pad must be between 1 and 8")
+	case s.JumpTo < 0 || s.JumpTo > 8:
+		return fmt.Errorf("jumpTo must be between 1 and 8")
+	case s.X < -500 || s.X > 500 || s.Y < -500 || s.Y > 500:
+		return fmt.Errorf("x and y must be between -500 and 500")
+	case s.Z < 0 || s.Z > 500:
+		return fmt.Errorf("z must be between 0 and 500")
+	case abs(s.X) <= 20 && abs(s.Y) <= 20 && abs(s.Z) <= 20:
+		return fmt.Errorf("x, y and z cannot all be between -20 and 20")
+	case s.Speed < 10 || s.Speed > 100:
+		return fmt.Errorf("speed must be between 10 and 100")
+	case s.Yaw < 0 || s.Yaw > 360:
+		return fmt.Errorf("yaw must be between 0 and 360")
+	}
+	return nil
+}
+
+func (s MissionStep) command() string {
+	if s.JumpTo != 0 {
+		return fmt.Sprintf("jump %d %d %d %d %d m%d m%d", s.X, s.Y, s.Z, s.Speed, s.Yaw, s.Pad, s.JumpTo)
+	}
+	return fmt.Sprintf("go %d %d %d %d m%d", s.X, s.Y, s.Z, s.Speed, s.Pad)
+}
+
+// Repeatが0ならStopMissionまで繰り返す
+type Mission struct {
+	Steps  []MissionStep `json:"steps"`
+	Repeat int           `json:"repeat"`
+}
+
+func (m Mission) Validate() error {
+	if len(m.Steps) == 0 || len(m.Steps) > maxMissionSteps {
+		return fmt.Errorf("steps must have between 1 and %d items", maxMissionSteps)
+	}
+	if m.Repeat < 0 {
+		return fmt.Errorf("repeat must not be negative")
+	}
+	for i, s := range m.Steps {
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("steps[%d]: %s", i, err.Error())
+		}
+	}
+	return nil
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// GET /api/v1/mission。Step, Roundは実行中のステップと周回(1から)
+type MissionStatus struct {
+	Enabled bool       `json:"enabled"`
+	Running bool       `json:"running"`
+	Step    int        `json:"step"`
+	Round   int        `json:"round"`
+	Error   string     `json:"error,omitempty"`
+	Pad     MissionPad `json:"pad"`
+}
+
+// patrolControllerと同じく1つだけGoroutineを動かし、stopは終わるまで待つ。
+// missionは自分で終わることがあるので、終わった時はfinishを呼んでからモードを変える
+type missionController struct {
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	done    chan struct{}
+	step    int
+	round   int
+	lastErr string
+}
+
+func (m *missionController) start(run func(ctx context.Context) error, finish func(error)) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cancel != nil {
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	prev, done := m.done, make(chan struct{})
+	m.cancel, m.done, m.step, m.round, m.lastErr = cancel, done, 0, 0, ""
+	go func() {
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		err := run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		m.detach(done, err)
+		cancel()
+		finish(err)
+	}()
+	return true
+}
+
+// 自分で終わった時。stopが待たないようにcancelを外す
+func (m *missionController) detach(done chan struct{}, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.done == done {
+		m.cancel = nil
+	}
+	if err != nil {
+		m.lastErr = err.Error()
+	}
+}
+
+func (m *missionController) stop() {
+	m.mu.Lock()
+	cancel, done := m.cancel, m.done
+	m.cancel = nil
+	m.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+func (m *missionController) progress(round, step int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.round, m.step = round, step
+}
+
+func (m *missionController) status() MissionStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return MissionStatus{Running: m.cancel != nil, Step: m.step, Round: m.round, Error: m.lastErr}
+}
+
+// SDKのクライアントと、状態を受け取るポートを開く
+func (d *DroneManager) enableSDK(statePort int) {
+	sdk, err := newSDKClient(telloAddr)
+	if err != nil {
+		log.Printf("action=enableSDK err=%s", err.Error())
+		return
+	}
+	pads := &padStore{pad: MissionPad{ID: -1}}
+	if err := listenSDKState(statePort, pads.update); err != nil {
+		log.Printf("action=enableSDK port=%d err=%s", statePort, err.Error())
+		return
+	}
+	d.sdk, d.pads = sdk, pads
+}
+
+// SDKモードにしてmission padの検出を始める。ConnectedEventで呼ぶ
+func (d *DroneManager) enableMissionPads(direction int) {
+	for _, cmd := range []string{"command", "mon", fmt.Sprintf("mdirection %d", direction)} {
+		if err := d.sdk.do(context.Background(), cmd, sdkReplyTimeout); err != nil {
+			log.Printf("action=enableMissionPads command=%s err=%s", cmd, err.Error())
+			return
+		}
+	}
+}
+
+func (d *DroneManager) MissionPad() (MissionPad, bool) {
+	if d.pads == nil {
+		return MissionPad{}, false
+	}
+	return d.pads.get(), true
+}
+
+func (d *DroneManager) MissionStatus() MissionStatus {
+	status := d.mission.status()
+	status.Pad, status.Enabled = d.MissionPad()
+	return status
+}
+
+// ManualかPatrol, Trackingの時だけ始められる。pilotが操作したらManualに戻って止まる
+func (d *DroneManager) StartMission(m Mission) error {
+	if d.sdk == nil {
+		return ErrMissionPadsDisabled
+	}
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	if err := d.checkArmed(); err != nil {
+		return err
+	}
+	if _, err := d.state.transition(ModeMission, "start mission", ModeManual, ModePatrol, ModeTracking); err != nil {
+		return err
+	}
+	d.mission.start(func(ctx context.Context) error {
+		return d.flyMission(ctx, m)
+	}, func(err error) {
+		reason := "mission complete"
+		if err != nil {
+			reason = "mission failed"
+			log.Printf("action=flyMission err=%s", err.Error())
+		}
+		d.state.transition(ModeManual, reason, ModeMission)
+	})
+	return nil
+}
+
+// Manualに戻す。実行中のステップはSDKのstopでその場でHoverさせる
+func (d *DroneManager) StopMission() {
+	d.state.transition(ModeManual, "stop mission", ModeMission)
+}
+
+func (d *DroneManager) flyMission(ctx context.Context, m Mission) error {
+	err := d.flyMissionSteps(ctx, m)
+	if ctx.Err() != nil {
+		d.sdk.write("stop")
+	}
+	return err
+}
+
+func (d *DroneManager) flyMissionSteps(ctx context.Context, m Mission) error {
+	for round := 1; m.Repeat == 0 || round <= m.Repeat; round++ {
+		for i, step := range m.Steps {
+			d.mission.progress(round, i)
+			if err := d.missionStep(ctx, step); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// コマンドキューを通して送り、返事はキューの外で待つ。
+// 待っている間もLandや手動の操作はキューで実行できる
+func (d *DroneManager) missionStep(ctx context.Context, step MissionStep) error {
+	for {
+		err := d.move(PriorityAutonomous, "mission", func() error { return d.sdk.write(step.command()) })
+		if err == nil {
+			return d.sdk.await(ctx, missionStepTimeout)
+		}
+		if err != ErrPreempted {
+			return err
+		}
+		// 手動の操作の直後は自動のコマンドを受け付けないので、少し待ってから送り直す
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(autonomyHold):
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package models
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// テレメトリがこれより空いたら、その間は位置を進めない
+const odometryMaxStep = time.Second
+
+// 離陸した場所からの位置(m)。Yは離陸した時の前(TelloのNorth), Xは右(East), Zは高さ
+// TelloのNorth/EastSpeedは離陸した時の向きが基準なので、離陸する度に0に戻す
+type Position struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+func (p Position) horizontal() float64 {
+	return math.Hypot(p.X, p.Y)
+}
+
+// 離陸した場所からの推定の位置と向き。GET /api/v1/telemetry のodometry
+// yawは離陸した時の向きから時計回りの角度(度)
+type Odometry struct {
+	Position Position `json:"position"`
+	Velocity Position `json:"velocity"`
+	Yaw      float64  `json:"yaw"`
+	Distance float64  `json:"distance"`
+}
+
+// 位置はFlightDataの速度を積分する(dead reckoning)。
+// FlightDataには向きが無いので、yawは送った回転のスティック(Clockwise, rc等)から積分する。
+// yawRateはスティックを最大にした時の1秒の回転(度)。離陸する度に0に戻す
+type odometry struct {
+	mu       sync.Mutex
+	yawRate  float64
+	pos      Position
+	vel      Position
+	last     time.Time
+	yaw      float64
+	yawStick float64
+	yawAt    time.Time
+}
+
+func newOdometry(yawRate float64) *odometry {
+	return &odometry{yawRate: yawRate}
+}
+
+// FlightDataEventの度に呼ぶ
+func (o *odometry) update(t Telemetry, now time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !t.Flying {
+		o.pos, o.vel, o.last = Position{}, Position{}, now
+		o.yaw, o.yawStick, o.yawAt = 0, 0, now
+		return
+	}
+
+	// 速度の単位は0.1m/s, 高さは0.1m
+	o.vel = Position{X: float64(t.EastSpeed) / 10, Y: float64(t.NorthSpeed) / 10, Z: float64(t.VerticalSpeed) / 10}
+	if dt := now.Sub(o.last); !o.last.IsZero() && dt <= odometryMaxStep {
+		o.pos.X += o.vel.X * dt.Seconds()
+		o.pos.Y += o.vel.Y * dt.Seconds()
+	}
+	o.pos.Z = float64(t.Height) / 10
+	o.last = now
+}
+
+func (o *odometry) yawLocked(now time.Time) float64 {
+	if o.yawAt.IsZero() {
+		return o.yaw
+	}
+	return o.yaw + o.yawStick*o.yawRate*now.Sub(o.yawAt).Seconds()
+}
+
+// 回転のスティックを送る時に呼ぶ。-1から1で、正が時計回り
+func (o *odometry) setYawStick(v float64, now time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.yaw = normalizeAngle(o.yawLocked(now))
+	o.yawStick, o.yawAt = v, now
+}
+
+func (o *odometry) estimate(now time.Time) Odometry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return Odometry{
+		Position: o.pos,
+		Velocity: o.vel,
+		Yaw:      normalizeAngle(o.yawLocked(now)),
+		Distance: o.pos.horizontal(),
+	}
+}
+
+// -180から180にする
+func normalizeAngle(deg float64) float64 {
+	deg = math.Mod(deg+180, 360)
+	if deg < 0 {
+		deg += 360
+	}
+	return deg - 180
+}
+
+func (d *DroneManager) Odometry() Odometry {
+	return d.odometry.estimate(time.Now())
+}
+
+// DriverのSetVectorに回転を記録する処理を足したもの。rcとreturnHomeはこれで送る。
+// gobotのSetVector(x, y, z, psi)は、xが前後(pitch), yが左右(roll), zが上下(throttle), psiが回転(yaw)。
+// どれも-1から1で、前, 右, 上, 時計回りが+
+func (d *DroneManager) setVector(pitch, roll, throttle, yaw float64) error {
+	d.odometry.setYawStick(yaw, time.Now())
+	return d.Driver.SetVector(pitch, roll, throttle, yaw)
+}
+
+// Hoverも回転を止めるので記録する
+func (d *DroneManager) hover() {
+	d.odometry.setYawStick(0, time.Now())
+	d.Driver.Hover()
+}
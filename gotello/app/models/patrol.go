@@ -0,0 +1,92 @@
+package models
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 巡回の1ステップの時間
+const patrolInterval = 3 * time.Second
+
+// patrolで使う動作。DroneManagerではautopilot(優先度が低いコマンド)を渡す
+// StopHoverは止めた時の最後のHover
+type patrolPilot interface {
+	Hover() error
+	StopHover() error
+	Forward(speed int) error
+	Right(speed int) error
+	Backward(speed int) error
+	Left(speed int) error
+}
+
+// 巡回のGoroutineを1つだけ動かす。止める時はcontextをcancelして、Hoverが終わるまで待つ
+// cancelがnilでなければ動いている
+type patrolController struct {
+	mu       sync.Mutex
+	pilot    patrolPilot
+	speed    func() int
+	interval time.Duration
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func newPatrolController(pilot patrolPilot, speed func() int, interval time.Duration) *patrolController {
+	return &patrolController{pilot: pilot, speed: speed, interval: interval}
+}
+
+// 巡回を始める。既に動いていればfalse
+func (p *patrolController) start() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel != nil {
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	// 前回のstopがまだHoverしている途中なら、終わってから始める
+	prev, done := p.done, make(chan struct{})
+	p.cancel, p.done = cancel, done
+	go func() {
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		p.loop(ctx)
+	}()
+	return true
+}
+
+// 巡回を止めて、最後のHoverが終わるまで待つ。動いていなければ何もしない
+// stopが返った後は、patrolからドローンにコマンドは送られない
+func (p *patrolController) stop() {
+	p.mu.Lock()
+	cancel, done := p.cancel, p.done
+	p.cancel = nil
+	p.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// 毎回Hoverしてから、休み、前、右、後ろ、左の順に動く
+func (p *patrolController) loop(ctx context.Context) {
+	steps := []func(int) error{nil, p.pilot.Forward, p.pilot.Right, p.pilot.Backward, p.pilot.Left}
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for status := 0; ; status = (status + 1) % len(steps) {
+		select {
+		case <-ctx.Done():
+			p.pilot.StopHover()
+			return
+		case <-t.C:
+		}
+		p.pilot.Hover()
+		// Hoverの間に止められていたら動かない
+		if ctx.Err() != nil || steps[status] == nil {
+			continue
+		}
+		steps[status](p.speed())
+	}
+}
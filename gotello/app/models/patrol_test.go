@@ -0,0 +1,244 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"gobot.io/x/gobot/platforms/dji/tello"
+)
+
+// 呼ばれた動作を記録する。gateがnilでなければ、Hoverはgateが閉じられるまで返らない
+type fakePatrolPilot struct {
+	mu     sync.Mutex
+	calls  []string
+	active int
+	gate   chan struct{}
+}
+
+func (f *fakePatrolPilot) do(call string) error {
+	f.mu.Lock()
+	f.calls = append(f.calls, call)
+	f.active++
+	gate := f.gate
+	f.mu.Unlock()
+	if call == "hover" && gate != nil {
+		<-gate
+	}
+	f.mu.Lock()
+	f.active--
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *fakePatrolPilot) Hover() error             { return f.do("hover") }
+func (f *fakePatrolPilot) StopHover() error         { return f.do("stopHover") }
+func (f *fakePatrolPilot) Forward(speed int) error  { return f.do(fmt.Sprintf("forward %d", speed)) }
+func (f *fakePatrolPilot) Right(speed int) error    { return f.do(fmt.Sprintf("right %d", speed)) }
+func (f *fakePatrolPilot) Backward(speed int) error { return f.do(fmt.Sprintf("backward %d", speed)) }
+func (f *fakePatrolPilot) Left(speed int) error     { return f.do(fmt.Sprintf("left %d", speed)) }
+
+func (f *fakePatrolPilot) snapshot() ([]string, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...), f.active
+}
+
+// condがtrueになるまで待つ。5秒経ったら失敗にする
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (f *fakePatrolPilot) called(call string, after int) func() bool {
+	return func() bool {
+		calls, _ := f.snapshot()
+		for _, c := range calls[after:] {
+			if c == call {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func newTestPatrol(pilot *fakePatrolPilot) *patrolController {
+	return newPatrolController(pilot, func() int { return 20 }, time.Millisecond)
+}
+
+// stopが返った時には、Goroutineが終わって最後のStopHoverも返っていること
+func stopAndCheck(t *testing.T, p *patrolController, pilot *fakePatrolPilot) {
+	t.Helper()
+	p.mu.Lock()
+	done := p.done
+	p.mu.Unlock()
+	p.stop()
+	select {
+	case <-done:
+	default:
+		t.Fatal("stop returned before the patrol goroutine exited")
+	}
+	calls, active := pilot.snapshot()
+	if active != 0 {
+		t.Fatalf("%d pilot calls still running after stop", active)
+	}
+	if last := calls[len(calls)-1]; last != "stopHover" {
+		t.Fatalf("last call = %s, want stopHover", last)
+	}
+}
+
+func TestPatrolStartStop(t *testing.T) {
+	pilot := &fakePatrolPilot{}
+	p := newTestPatrol(pilot)
+	if !p.start() {
+		t.Fatal("start returned false")
+	}
+	if p.start() {
+		t.Fatal("second start returned true while running")
+	}
+	// 休みの後に前から動く
+	waitUntil(t, "forward", pilot.called("forward 20", 0))
+	waitUntil(t, "left", pilot.called("left 20", 0))
+	stopAndCheck(t, p, pilot)
+
+	// stopの後はコマンドを送らない
+	before, _ := pilot.snapshot()
+	time.Sleep(20 * time.Millisecond)
+	if after, _ := pilot.snapshot(); len(after) != len(before) {
+		t.Fatalf("pilot was called after stop: %v", after[len(before):])
+	}
+}
+
+func TestPatrolStopWhenNotRunning(t *testing.T) {
+	pilot := &fakePatrolPilot{}
+	p := newTestPatrol(pilot)
+	p.stop()
+	if !p.start() {
+		t.Fatal("start returned false")
+	}
+	waitUntil(t, "hover", pilot.called("hover", 0))
+	stopAndCheck(t, p, pilot)
+	p.stop()
+	if calls, _ := pilot.snapshot(); calls[len(calls)-1] != "stopHover" {
+		t.Fatalf("second stop called the pilot: %v", calls)
+	}
+}
+
+// Hoverの途中で止めても、stopはHoverが終わるまで返らない
+func TestPatrolStopWhileRunning(t *testing.T) {
+	gate := make(chan struct{})
+	pilot := &fakePatrolPilot{gate: gate}
+	p := newTestPatrol(pilot)
+	p.start()
+	waitUntil(t, "hover to block", func() bool {
+		_, active := pilot.snapshot()
+		return active > 0
+	})
+
+	p.mu.Lock()
+	done := p.done
+	p.mu.Unlock()
+	stopped := make(chan struct{})
+	go func() {
+		p.stop()
+		close(stopped)
+	}()
+	// stopがcancelして、Goroutineの終わりを待ち始めるまで待つ
+	waitUntil(t, "stop to cancel", func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.cancel == nil
+	})
+	select {
+	case <-stopped:
+		t.Fatal("stop returned while the pilot was still hovering")
+	default:
+	}
+
+	close(gate)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop did not return after the hover finished")
+	}
+	select {
+	case <-done:
+	default:
+		t.Fatal("stop returned before the patrol goroutine exited")
+	}
+	if _, active := pilot.snapshot(); active != 0 {
+		t.Fatalf("%d pilot calls still running after stop", active)
+	}
+}
+
+func TestPatrolRestartAfterStop(t *testing.T) {
+	pilot := &fakePatrolPilot{}
+	p := newTestPatrol(pilot)
+	p.start()
+	waitUntil(t, "forward", pilot.called("forward 20", 0))
+	stopAndCheck(t, p, pilot)
+
+	calls, _ := pilot.snapshot()
+	if !p.start() {
+		t.Fatal("start after stop returned false")
+	}
+	waitUntil(t, "forward after restart", pilot.called("forward 20", len(calls)))
+	stopAndCheck(t, p, pilot)
+}
+
+// ドローンの代わりに、送られたコマンドを記録する。
+// テストで使わないメソッドは埋め込んだnilのDriverで、呼ばれたらpanicする
+type fakeDriver struct {
+	Driver
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *fakeDriver) record(call string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+}
+
+func (f *fakeDriver) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func (f *fakeDriver) Hover()                { f.record("hover") }
+func (f *fakeDriver) Forward(val int) error { f.record(fmt.Sprintf("forward %d", val)); return nil }
+
+// rcは20ミリセカンド毎に送るので記録しない
+func (f *fakeDriver) SetVector(x, y, z, psi float64) error { return nil }
+
+// 手動の操作の直後(autonomyHoldの間)に止めても、最後のHoverはドローンに送られる
+func TestStopPatrolHoversAfterManualCommand(t *testing.T) {
+	driver := &fakeDriver{}
+	d := NewDroneManagerWithDriver(driver)
+	d.UpdateFlightData(&tello.FlightData{Flying: true})
+
+	if err := d.Forward(20); err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+	if err := d.StartPatrol(); err != nil {
+		t.Fatalf("StartPatrol: %v", err)
+	}
+	d.StopPatrol()
+
+	want := []string{"forward 20", "hover"}
+	if got := driver.Calls(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("driver calls = %v, want %v", got, want)
+	}
+	if mode := d.FlightMode(); mode != ModeManual {
+		t.Fatalf("mode = %s, want manual", mode)
+	}
+}
@@ -0,0 +1,104 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+var (
+	ErrInvalidProfileName = errors.New("profile name must be 1-32 letters, digits, '-' or '_'")
+
+	// ファイル名にするので、パスに使える文字だけにする
+	validProfileName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+)
+
+// パイロット毎の操縦の設定。dirの下に<name>.jsonで保存する
+type Profile struct {
+	Gamepad  *GamepadProfile  `json:"gamepad,omitempty"`
+	Keyboard *KeyboardProfile `json:"keyboard,omitempty"`
+}
+
+type ProfileStore struct {
+	mu       sync.Mutex
+	dir      string
+	profiles map[string]Profile
+}
+
+// ファイル名に使える名前か。アカウントの名前をそのままprofileにできるか調べる
+func ValidProfileName(name string) bool {
+	return validProfileName.MatchString(name)
+}
+
+func NewProfileStore(dir string) *ProfileStore {
+	return &ProfileStore{dir: dir, profiles: map[string]Profile{}}
+}
+
+func (s *ProfileStore) path(name string) string {
+	return filepath.Join(s.dir, name+".json")
+}
+
+// 保存されていない場合は空のProfileを返す
+func (s *ProfileStore) Get(name string) (Profile, error) {
+	if !ValidProfileName(name) {
+		return Profile{}, ErrInvalidProfileName
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(name)
+}
+
+// 一度読んだProfileはメモリに持っておく。gamepadの入力の度にファイルを読まないように
+func (s *ProfileStore) load(name string) (Profile, error) {
+	if p, ok := s.profiles[name]; ok {
+		return p, nil
+	}
+	var p Profile
+	js, err := os.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(js, &p); err != nil {
+		return p, err
+	}
+	s.profiles[name] = p
+	return p, nil
+}
+
+// fで変更してから保存する。他の設定(gamepad, keyboard等)は残す
+func (s *ProfileStore) Update(name string, f func(p *Profile)) (Profile, error) {
+	if !ValidProfileName(name) {
+		return Profile{}, ErrInvalidProfileName
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, err := s.load(name)
+	if err != nil {
+		return p, err
+	}
+	f(&p)
+
+	js, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return p, err
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return p, err
+	}
+	// 途中で落ちても壊れたファイルが残らないように、一時ファイルからrenameする
+	tmp := s.path(name) + ".tmp"
+	if err := os.WriteFile(tmp, js, 0644); err != nil {
+		return p, err
+	}
+	if err := os.Rename(tmp, s.path(name)); err != nil {
+		return p, err
+	}
+	s.profiles[name] = p
+	return p, nil
+}
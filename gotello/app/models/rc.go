@@ -0,0 +1,162 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// gobotは20ミリセカンド毎にスティックの値をドローンに送るので、同じ間隔で値を更新する
+	rcTickInterval = 20 * time.Millisecond
+	rcMaxStick     = 100
+	// これより小さくなったら0にする
+	rcDeadZone = 0.5
+)
+
+var ErrInvalidStick = errors.New("stick values must be between -100 and 100")
+
+// ジョイスティックのようにroll, pitch, throttle, yawを同時に動かす。-100..100
+// roll: 右が+, pitch: 前が+, throttle: 上が+, yaw: 時計回りが+
+type Sticks struct {
+	Roll     int `json:"roll"`
+	Pitch    int `json:"pitch"`
+	Throttle int `json:"throttle"`
+	Yaw      int `json:"yaw"`
+}
+
+func (s Sticks) valid() bool {
+	for _, v := range []int{s.Roll, s.Pitch, s.Throttle, s.Yaw} {
+		if v < -rcMaxStick || v > rcMaxStick {
+			return false
+		}
+	}
+	return true
+}
+
+// rcController: 受け取った値(target)に少しずつ近づけて(current)、ドローンに送る。
+// timeoutの間に新しい値が来なければtargetを0にする（通信が切れても飛んで行かないように）
+// 0になったら送るのをやめるので、up, forward等のコマンドを上書きしない
+type rcController struct {
+	mu        sync.Mutex
+	target    [4]float64
+	current   [4]float64
+	updatedAt time.Time
+	active    bool
+	timeout   time.Duration
+	// 1tick毎にtargetとの差のどれだけ近づけるか。1なら平滑化しない
+	smoothing float64
+	setVector func(pitch, roll, throttle, yaw float64) error
+}
+
+func newRCController(timeout time.Duration, smoothing float64, setVector func(pitch, roll, throttle, yaw float64) error) *rcController {
+	if smoothing <= 0 || smoothing > 1 {
+		smoothing = 1
+	}
+	return &rcController{timeout: timeout, smoothing: smoothing, setVector: setVector}
+}
+
+// スティックを触っていない時に0を送り続けても、up, forward等のコマンドを上書きしないようにする
+func (c *rcController) set(s Sticks) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.active && s == (Sticks{}) {
+		return
+	}
+	c.target = [4]float64{float64(s.Roll), float64(s.Pitch), float64(s.Throttle), float64(s.Yaw)}
+	c.updatedAt = time.Now()
+	c.active = true
+}
+
+func (c *rcController) sticks() Sticks {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Sticks{
+		Roll:     int(math.Round(c.current[0])),
+		Pitch:    int(math.Round(c.current[1])),
+		Throttle: int(math.Round(c.current[2])),
+		Yaw:      int(math.Round(c.current[3])),
+	}
+}
+
+// すぐに0にする。Hoverやemergencyの時に使う
+func (c *rcController) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.target = [4]float64{}
+	c.current = [4]float64{}
+	c.active = false
+}
+
+// 次にドローンに送る値を計算する。送る必要が無い場合はfalse
+func (c *rcController) step(now time.Time) ([4]float64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.active {
+		return c.current, false
+	}
+	if now.Sub(c.updatedAt) > c.timeout {
+		c.target = [4]float64{}
+	}
+	idle := true
+	for i := range c.current {
+		c.current[i] += (c.target[i] - c.current[i]) * c.smoothing
+		if math.Abs(c.current[i]) < rcDeadZone && c.target[i] == 0 {
+			c.current[i] = 0
+		}
+		if c.current[i] != 0 || c.target[i] != 0 {
+			idle = false
+		}
+	}
+	// 最後に0を1回送ってから止める
+	if idle {
+		c.active = false
+	}
+	return c.current, true
+}
+
+func (c *rcController) run() {
+	ticker := time.NewTicker(rcTickInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		v, ok := c.step(now)
+		if !ok {
+			continue
+		}
+		// vはroll, pitch, throttle, yawの順。setVectorはpitchが先
+		if err := c.setVector(v[1]/rcMaxStick, v[0]/rcMaxStick, v[2]/rcMaxStick, v[3]/rcMaxStick); err != nil {
+			log.Printf("action=rcController err=%s", err.Error())
+		}
+	}
+}
+
+// 斜めに飛びながら回転や上昇ができる。高い頻度(10~50Hz)で送り続けること
+func (d *DroneManager) SetSticks(s Sticks) error {
+	if !s.valid() {
+		return ErrInvalidStick
+	}
+	// スティックを離している(0)だけならエラーにしない
+	if s != (Sticks{}) {
+		if err := d.checkArmed(); err != nil {
+			return err
+		}
+	}
+	// returnHomeも同じrcで飛ぶので、触っていないクライアントが送り続ける0で戻る方向を上書きしない
+	if s == (Sticks{}) && d.FlightMode() == ModeReturnHome {
+		return nil
+	}
+	// rcで操縦している間は自動のコマンドを止める
+	if s != (Sticks{}) {
+		d.arbiter.holdAutonomy()
+		d.manualOverride()
+	}
+	d.rc.set(d.fence.limitSticks(s))
+	return nil
+}
+
+// 今ドローンに送っている値（平滑化した後）
+func (d *DroneManager) Sticks() Sticks {
+	return d.rc.sticks()
+}
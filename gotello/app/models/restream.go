@@ -0,0 +1,215 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	RestreamHLS  = "hls"
+	RestreamRTSP = "rtsp"
+	hlsPlaylist  = "stream.m3u8"
+	// 約2秒分のパケット。ffmpegが詰まったらそれ以上は捨てる
+	restreamQueueSize = 256
+	// Stopしてもffmpegが終わらなければkillする
+	restreamStopTimeout = 5 * time.Second
+)
+
+var (
+	ErrUnknownRestreamFormat = errors.New("unknown restream format")
+	ErrRestreamRunning       = errors.New("restream is already running")
+	ErrRestreamNotRunning    = errors.New("restream is not running")
+	ErrNoRTSPURL             = errors.New("rtsp url is not configured")
+)
+
+// VLCや他のダッシュボードから見れるように、ffmpegでHLS, RTSPに再配信する。
+// H.264のパケットをそのままffmpegのpipe:0に書き込み、フォーマット毎にffmpegを１つ走らせる。
+// 書き込みはフォーマット毎のGoroutineで行い、ffmpegやRTSPサーバーが詰まっても
+// VideoFrameEventのハンドラー(デコーダーやWebRTC)を止めない。
+type Restreamer struct {
+	mu      sync.Mutex
+	HLSDir  string
+	RTSPURL string
+	Width   int
+	Height  int
+	outputs map[string]*restreamOutput
+}
+
+type restreamOutput struct {
+	cmd      *exec.Cmd
+	in       io.WriteCloser
+	packets  chan []byte
+	exited   chan struct{}
+	dropping bool
+	RestreamStatus
+}
+
+// キューのパケットをffmpegに書き込む。Stopでキューが閉じられたらstdinを閉じる
+func (o *restreamOutput) writeLoop(format string) {
+	failed := false
+	for pkt := range o.packets {
+		if failed {
+			continue
+		}
+		if _, err := o.in.Write(pkt); err != nil {
+			// ffmpegが終わった後は書き込めないので、ログは1回だけ
+			log.Printf("action=Restreamer.writeLoop format=%s err=%s", format, err.Error())
+			failed = true
+		}
+	}
+	o.in.Close()
+}
+
+type RestreamStatus struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func NewRestreamer(hlsDir, rtspURL string, width, height int) *Restreamer {
+	return &Restreamer{
+		HLSDir:  hlsDir,
+		RTSPURL: rtspURL,
+		Width:   width,
+		Height:  height,
+		outputs: map[string]*restreamOutput{},
+	}
+}
+
+// width, heightが0の場合はconfigの値を使う
+func (r *Restreamer) Start(format string, width, height int) error {
+	if width <= 0 || height <= 0 {
+		width, height = r.Width, r.Height
+	}
+	size := strconv.Itoa(width) + "x" + strconv.Itoa(height)
+
+	// ultrafast, zerolatency: ドローンの操縦と一緒に見るので遅延を優先
+	args := []string{"-f", "h264", "-i", "pipe:0",
+		"-c:v", "libx264", "-preset", "ultrafast", "-tune", "zerolatency", "-s", size}
+	switch format {
+	case RestreamHLS:
+		if err := os.MkdirAll(r.HLSDir, 0755); err != nil {
+			return err
+		}
+		args = append(args, "-f", "hls", "-hls_time", "1", "-hls_list_size", "5",
+			"-hls_flags", "delete_segments", filepath.Join(r.HLSDir, hlsPlaylist))
+	case RestreamRTSP:
+		// ffmpegはRTSPサーバーにはなれないので、rtsp-simple-server等にpublishする
+		if r.RTSPURL == "" {
+			return ErrNoRTSPURL
+		}
+		args = append(args, "-f", "rtsp", "-rtsp_transport", "tcp", r.RTSPURL)
+	default:
+		return ErrUnknownRestreamFormat
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.outputs[format]; ok {
+		return ErrRestreamRunning
+	}
+
+	cmd := exec.Command("ffmpeg", args...)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	output := &restreamOutput{
+		cmd:            cmd,
+		in:             in,
+		packets:        make(chan []byte, restreamQueueSize),
+		exited:         make(chan struct{}),
+		RestreamStatus: RestreamStatus{Width: width, Height: height},
+	}
+	r.outputs[format] = output
+	log.Printf("action=Restreamer.Start format=%s size=%s", format, size)
+	go output.writeLoop(format)
+
+	// ffmpegが落ちたら出力から外す
+	go func() {
+		err := cmd.Wait()
+		close(output.exited)
+		log.Printf("action=Restreamer.Wait format=%s err=%v", format, err)
+		r.mu.Lock()
+		if r.outputs[format] == output {
+			delete(r.outputs, format)
+			close(output.packets)
+		}
+		r.mu.Unlock()
+	}()
+	return nil
+}
+
+// キューに残ったパケットを書き終えるとstdinが閉じて、ffmpegはHLSのプレイリストを書き終えてから終了する。
+// 待たずに返り、restreamStopTimeoutの間に終わらなければkillする
+func (r *Restreamer) Stop(format string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	output, ok := r.outputs[format]
+	if !ok {
+		return ErrRestreamNotRunning
+	}
+	delete(r.outputs, format)
+	close(output.packets)
+	log.Printf("action=Restreamer.Stop format=%s", format)
+	go func() {
+		select {
+		case <-output.exited:
+		case <-time.After(restreamStopTimeout):
+			log.Printf("action=Restreamer.Stop format=%s err=ffmpeg did not exit, killed", format)
+			output.cmd.Process.Kill()
+		}
+	}()
+	return nil
+}
+
+// 書き込みは待たない。キューが一杯のフォーマットにはパケットを捨てる
+func (r *Restreamer) WritePacket(pkt []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.outputs) == 0 {
+		return
+	}
+	// 書き込むのは後なので、gobotのバッファが使い回されても大丈夫なようにコピーする
+	pkt = append([]byte(nil), pkt...)
+	for format, output := range r.outputs {
+		select {
+		case output.packets <- pkt:
+			if output.dropping {
+				log.Printf("action=Restreamer.WritePacket format=%s resumed", format)
+				output.dropping = false
+			}
+		default:
+			if !output.dropping {
+				log.Printf("action=Restreamer.WritePacket format=%s err=ffmpeg is not keeping up, dropping packets", format)
+				output.dropping = true
+			}
+		}
+	}
+}
+
+// 配信中のフォーマットと解像度を返す
+func (r *Restreamer) Status() map[string]RestreamStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := map[string]RestreamStatus{}
+	for format, output := range r.outputs {
+		status[format] = output.RestreamStatus
+	}
+	return status
+}
+
+// HLSDirはstaticフォルダの下にある前提。static経由で配信される。
+func (r *Restreamer) HLSPlaylistURL() string {
+	return fmt.Sprintf("/%s", filepath.ToSlash(filepath.Join(r.HLSDir, hlsPlaylist)))
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"github.com/roy1210/Study/Go-drone/gotello/config"
+)
+
+const (
+	returnHomeTick = 100 * time.Millisecond
+	// この距離(m)と角度(度)まで戻ったら着陸する
+	returnHomeTolerance    = 0.3
+	returnHomeYawTolerance = 10.0
+	// この距離(m)より近づいたら遅くする
+	returnHomeSlowdown = 1.0
+	// 戻れなかった時はManualにしてパイロットに任せる
+	returnHomeTimeout = time.Minute
+)
+
+// 離陸した場所に戻って着陸する。odometryの推定の位置と向きを逆にたどる
+// ManualかPatrol, Tracking, Missionの時だけできる
+func (d *DroneManager) ReturnHome() error {
+	if err := d.checkArmed(); err != nil {
+		return err
+	}
+	if _, err := d.state.transition(ModeReturnHome, "return home", ModeManual, ModePatrol, ModeTracking, ModeMission); err != nil {
+		return err
+	}
+	go d.returnHome(config.Config.ReturnHomeSpeed)
+	return nil
+}
+
+// rcのスティックで動かす。パイロットが操作したり、緊急停止で別のモードになったらやめる
+// どの終わり方でもスティックを0に戻して、残った値で飛んで行かないようにする
+func (d *DroneManager) returnHome(speed int) {
+	t := time.NewTicker(returnHomeTick)
+	defer t.Stop()
+	defer d.rc.reset()
+	deadline := time.Now().Add(returnHomeTimeout)
+	for range t.C {
+		if d.FlightMode() != ModeReturnHome {
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Printf("action=returnHome err=timeout")
+			d.rc.reset()
+			d.state.transition(ModeManual, "return home timeout", ModeReturnHome)
+			return
+		}
+		sticks, arrived := returnHomeSticks(d.Odometry(), speed)
+		if arrived {
+			// 着陸する前に止める
+			d.rc.reset()
+			if err := d.Land(); err != nil {
+				log.Printf("action=returnHome err=%s", err.Error())
+			}
+			return
+		}
+		d.rc.set(sticks)
+		// setの間に緊急停止されていたら、スティックを残さない
+		if d.checkArmed() != nil {
+			return
+		}
+	}
+}
+
+// 先に離陸した場所まで水平に戻り、その後に離陸した時の向きに戻す。着いたらtrue
+func returnHomeSticks(o Odometry, speed int) (Sticks, bool) {
+	if o.Distance > returnHomeTolerance {
+		// 離陸した場所への向きを、機体の前と右に直す。yawは時計回り
+		hx, hy := -o.Position.X, -o.Position.Y
+		yaw := o.Yaw * math.Pi / 180
+		forward := hx*math.Sin(yaw) + hy*math.Cos(yaw)
+		right := hx*math.Cos(yaw) - hy*math.Sin(yaw)
+		scale := float64(speed) / o.Distance
+		if o.Distance < returnHomeSlowdown {
+			scale *= o.Distance / returnHomeSlowdown
+		}
+		return Sticks{Roll: int(right * scale), Pitch: int(forward * scale)}, false
+	}
+	if math.Abs(o.Yaw) > returnHomeYawTolerance {
+		if o.Yaw > 0 {
+			return Sticks{Yaw: -speed}, false
+		}
+		return Sticks{Yaw: speed}, false
+	}
+	return Sticks{}, true
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"gobot.io/x/gobot/platforms/dji/tello"
+
+	"github.com/roy1210/Study/Go-drone/gotello/config"
+)
+
+func (c *rcController) targetSticks() Sticks {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Sticks{Roll: int(c.target[0]), Pitch: int(c.target[1]), Throttle: int(c.target[2]), Yaw: int(c.target[3])}
+}
+
+// gamepadやkeyboardのクライアントは、触っていなくても0のスティックを送り続ける。
+// returnHomeの間はその0で戻る方向を上書きしない
+func TestReturnHomeIgnoresZeroSticks(t *testing.T) {
+	d := NewDroneManagerWithDriver(&fakeDriver{})
+	d.UpdateFlightData(&tello.FlightData{Flying: true})
+	// 離陸した場所から2m前にいる
+	d.odometry.mu.Lock()
+	d.odometry.pos = Position{Y: 2}
+	d.odometry.mu.Unlock()
+
+	if err := d.ReturnHome(); err != nil {
+		t.Fatalf("ReturnHome: %v", err)
+	}
+	want, arrived := returnHomeSticks(d.Odometry(), config.Config.ReturnHomeSpeed)
+	if arrived || want == (Sticks{}) {
+		t.Fatalf("returnHomeSticks = %+v, %v, want sticks towards home", want, arrived)
+	}
+	waitUntil(t, "return home sticks", func() bool { return d.rc.targetSticks() == want })
+
+	// returnHomeのtick(100ミリセカンド)より速く、10Hzより多めに送る
+	for i := 0; i < 10; i++ {
+		if err := d.SetSticks(Sticks{}); err != nil {
+			t.Fatalf("SetSticks: %v", err)
+		}
+		if got := d.rc.targetSticks(); got != want {
+			t.Fatalf("sticks after a zero input = %+v, want %+v", got, want)
+		}
+		time.Sleep(returnHomeTick / 3)
+	}
+	if mode := d.FlightMode(); mode != ModeReturnHome {
+		t.Fatalf("mode = %s, want returnHome", mode)
+	}
+
+	// スティックを倒したらパイロットに任せる
+	if err := d.SetSticks(Sticks{Roll: 20}); err != nil {
+		t.Fatalf("SetSticks: %v", err)
+	}
+	if mode := d.FlightMode(); mode != ModeManual {
+		t.Fatalf("mode = %s, want manual", mode)
+	}
+}
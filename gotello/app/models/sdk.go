@@ -0,0 +1,127 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SDKのテキストコマンドの返事を待つ時間。goやjumpは移動が終わってから返事が来る
+const sdkReplyTimeout = 5 * time.Second
+
+var ErrSDKTimeout = errors.New("no reply from the drone")
+
+// Tello SDK 2.0のテキストコマンドを送るクライアント。
+// gobotはバイナリのプロトコルを使うので、mission padのコマンドはこちらで送る。
+// 返事は送ったポートに返ってくるので、gobotとは別のソケットを使う
+type sdkClient struct {
+	conn    net.Conn
+	replies chan string
+}
+
+func newSDKClient(addr string) (*sdkClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &sdkClient{conn: conn, replies: make(chan string, 8)}
+	go c.readReplies()
+	return c, nil
+}
+
+func (c *sdkClient) readReplies() {
+	buf := make([]byte, 1024)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			log.Printf("action=sdkClient err=%s", err.Error())
+			return
+		}
+		select {
+		case c.replies <- strings.TrimSpace(string(buf[:n])):
+		default:
+		}
+	}
+}
+
+// 返事を待たずに送る。前のコマンドの残りの返事は捨てる
+func (c *sdkClient) write(cmd string) error {
+drain:
+	for {
+		select {
+		case <-c.replies:
+		default:
+			break drain
+		}
+	}
+	_, err := c.conn.Write([]byte(cmd))
+	return err
+}
+
+// 次の返事を待つ。okならnil
+func (c *sdkClient) await(ctx context.Context, timeout time.Duration) error {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case reply := <-c.replies:
+		if reply == "ok" {
+			return nil
+		}
+		return fmt.Errorf("drone replied %q", reply)
+	case <-t.C:
+		return ErrSDKTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *sdkClient) do(ctx context.Context, cmd string, timeout time.Duration) error {
+	if err := c.write(cmd); err != nil {
+		return err
+	}
+	return c.await(ctx, timeout)
+}
+
+// SDKモードの時にTelloが8890番ポートに送ってくる状態。
+// "mid:1;x:10;y:-5;z:80;mpry:0,0,0;pitch:0;roll:0;yaw:90;..." のような形
+func parseSDKState(line string) map[string]string {
+	state := map[string]string{}
+	for _, field := range strings.Split(strings.TrimSpace(line), ";") {
+		kv := strings.SplitN(field, ":", 2)
+		if len(kv) == 2 {
+			state[kv[0]] = kv[1]
+		}
+	}
+	return state
+}
+
+func stateInt(state map[string]string, key string) int {
+	v, _ := strconv.Atoi(state[key])
+	return v
+}
+
+// 状態を受け取り続けて、mission padの情報をfに渡す
+func listenSDKState(port int, f func(map[string]string)) error {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, 1024)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				log.Printf("action=listenSDKState err=%s", err.Error())
+				return
+			}
+			f(parseSDKState(string(buf[:n])))
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,231 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ドローンの飛行モード。1つのモードだけを持ち、決められた遷移しかできない
+type FlightMode string
+
+const (
+	ModeDisconnected FlightMode = "disconnected"
+	ModeGrounded     FlightMode = "grounded"
+	ModeTakingOff    FlightMode = "takingOff"
+	ModeManual       FlightMode = "manual"
+	ModePatrol       FlightMode = "patrol"
+	ModeTracking     FlightMode = "tracking"
+	ModeMission      FlightMode = "mission"
+	ModeReturnHome   FlightMode = "returnHome"
+	ModeLanding      FlightMode = "landing"
+	ModeEmergency    FlightMode = "emergency"
+)
+
+var FlightModes = []FlightMode{
+	ModeDisconnected, ModeGrounded, ModeTakingOff, ModeManual, ModePatrol,
+	ModeTracking, ModeMission, ModeReturnHome, ModeLanding, ModeEmergency,
+}
+
+// 自動で飛んでいるモード。パイロットが操作したらManualに戻す
+var autonomousModes = []FlightMode{ModePatrol, ModeTracking, ModeMission, ModeReturnHome}
+
+const (
+	// テレメトリがこの時間来なければDisconnectedにする
+	telemetryTimeout = 5 * time.Second
+	// 離陸のコマンドからこの時間飛ばなければGroundedに戻す
+	takeOffTimeout   = 10 * time.Second
+	stateHistorySize = 50
+)
+
+// 遷移できる先。Emergencyからは再アームでGroundedかManualにしか行けない
+var flightModeTransitions = map[FlightMode][]FlightMode{
+	ModeDisconnected: {ModeGrounded, ModeManual, ModeEmergency},
+	ModeGrounded:     {ModeTakingOff, ModeManual, ModeDisconnected, ModeEmergency},
+	ModeTakingOff:    {ModeManual, ModeGrounded, ModeLanding, ModeDisconnected, ModeEmergency},
+	ModeManual:       {ModePatrol, ModeTracking, ModeMission, ModeReturnHome, ModeLanding, ModeGrounded, ModeDisconnected, ModeEmergency},
+	ModePatrol:       {ModeManual, ModeTracking, ModeReturnHome, ModeLanding, ModeGrounded, ModeDisconnected, ModeEmergency},
+	ModeTracking:     {ModeManual, ModePatrol, ModeReturnHome, ModeLanding, ModeGrounded, ModeDisconnected, ModeEmergency},
+	ModeMission:      {ModeManual, ModeReturnHome, ModeLanding, ModeGrounded, ModeDisconnected, ModeEmergency},
+	ModeReturnHome:   {ModeManual, ModeLanding, ModeGrounded, ModeDisconnected, ModeEmergency},
+	ModeLanding:      {ModeGrounded, ModeManual, ModeDisconnected, ModeEmergency},
+	ModeEmergency:    {ModeGrounded, ModeManual},
+}
+
+// 空中にいるモード
+func (m FlightMode) Airborne() bool {
+	switch m {
+	case ModeTakingOff, ModeManual, ModePatrol, ModeTracking, ModeMission, ModeReturnHome, ModeLanding:
+		return true
+	}
+	return false
+}
+
+func (m FlightMode) Autonomous() bool {
+	return containsMode(autonomousModes, m)
+}
+
+type InvalidTransitionError struct {
+	From FlightMode
+	To   FlightMode
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("cannot change flight mode from %s to %s", e.From, e.To)
+}
+
+// モードが変わった時のイベント
+type StateEvent struct {
+	From   FlightMode `json:"from"`
+	To     FlightMode `json:"to"`
+	Reason string     `json:"reason"`
+	At     time.Time  `json:"at"`
+}
+
+// GET /api/state
+type FlightState struct {
+	Mode   FlightMode   `json:"mode"`
+	Since  time.Time    `json:"since"`
+	Events []StateEvent `json:"events"`
+}
+
+type flightStateMachine struct {
+	mu        sync.Mutex
+	mode      FlightMode
+	since     time.Time
+	history   []StateEvent
+	listeners []func(StateEvent)
+}
+
+func newFlightStateMachine() *flightStateMachine {
+	return &flightStateMachine{mode: ModeDisconnected, since: time.Now()}
+}
+
+func (s *flightStateMachine) current() (FlightMode, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mode, s.since
+}
+
+// fromsのどれかのモードの時だけtoに遷移する。fromsが空ならどのモードからでも(遷移表の範囲で)
+// 同じモードへの遷移は何もしない
+func (s *flightStateMachine) transition(to FlightMode, reason string, froms ...FlightMode) (FlightMode, error) {
+	s.mu.Lock()
+	from := s.mode
+	if from == to {
+		s.mu.Unlock()
+		return from, nil
+	}
+	if len(froms) > 0 && !containsMode(froms, from) {
+		s.mu.Unlock()
+		return from, &InvalidTransitionError{From: from, To: to}
+	}
+	if !containsMode(flightModeTransitions[from], to) {
+		s.mu.Unlock()
+		return from, &InvalidTransitionError{From: from, To: to}
+	}
+	event := StateEvent{From: from, To: to, Reason: reason, At: time.Now()}
+	s.mode = to
+	s.since = event.At
+	if len(s.history) >= stateHistorySize {
+		s.history = append(s.history[:0], s.history[1:]...)
+	}
+	s.history = append(s.history, event)
+	listeners := append([]func(StateEvent){}, s.listeners...)
+	s.mu.Unlock()
+
+	log.Printf("action=transition from=%s to=%s reason=%s", from, to, reason)
+	// ロックの外で呼ぶ。listenerの中でまた遷移できるように
+	for _, l := range listeners {
+		l(event)
+	}
+	return from, nil
+}
+
+func (s *flightStateMachine) onTransition(l func(StateEvent)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, l)
+}
+
+// 新しい順
+func (s *flightStateMachine) snapshot() FlightState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := make([]StateEvent, len(s.history))
+	for i, e := range s.history {
+		events[len(s.history)-1-i] = e
+	}
+	return FlightState{Mode: s.mode, Since: s.since, Events: events}
+}
+
+func containsMode(modes []FlightMode, m FlightMode) bool {
+	for _, v := range modes {
+		if v == m {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *DroneManager) FlightMode() FlightMode {
+	mode, _ := d.state.current()
+	return mode
+}
+
+func (d *DroneManager) FlightState() FlightState {
+	return d.state.snapshot()
+}
+
+// モードが変わった時に呼ばれる。Prometheusやログ用
+func (d *DroneManager) OnTransition(l func(StateEvent)) {
+	d.state.onTransition(l)
+}
+
+// テレメトリからモードを進める。離陸・着陸の完了と、接続の切断を見つける
+func (d *DroneManager) updateStateFromTelemetry() {
+	t := d.telemetry.get()
+	mode, since := d.state.current()
+	now := time.Now()
+
+	if t.UpdatedAt.IsZero() || now.Sub(t.UpdatedAt) > telemetryTimeout {
+		if mode != ModeDisconnected && mode != ModeEmergency {
+			d.state.transition(ModeDisconnected, "telemetry timeout", mode)
+		}
+		return
+	}
+
+	// 読んだ後にモードが変わっていたら遷移しないように、fromにmodeを渡す
+	switch {
+	case mode == ModeDisconnected && t.Flying:
+		d.state.transition(ModeManual, "connected while flying", mode)
+	case mode == ModeDisconnected:
+		d.state.transition(ModeGrounded, "connected", mode)
+	case mode == ModeTakingOff && t.Flying:
+		d.state.transition(ModeManual, "took off", mode)
+	case mode == ModeTakingOff && now.Sub(since) > takeOffTimeout:
+		d.state.transition(ModeGrounded, "take off timeout", mode)
+	case mode == ModeGrounded && t.Flying:
+		d.state.transition(ModeManual, "flying", mode)
+	case mode == ModeLanding && !t.Flying:
+		d.state.transition(ModeGrounded, "landed", mode)
+	case (mode == ModeManual || mode.Autonomous()) && !t.Flying:
+		d.state.transition(ModeGrounded, "landed by the drone", mode)
+	}
+}
+
+// FlightDataEventが来なくなったことに気づけるように、定期的にも見る
+func (d *DroneManager) watchState() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for range t.C {
+		d.updateStateFromTelemetry()
+	}
+}
+
+// パイロットが動かしたら自動のモードをやめてManualにする
+func (d *DroneManager) manualOverride() {
+	d.hoverTimer.cancel()
+	d.state.transition(ModeManual, "manual override", autonomousModes...)
+}
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"sync"
+	"time"
+
+	"gobot.io/x/gobot/platforms/dji/tello"
+)
+
+// FlightDataEvent, WifiDataEventで送られてくるドローンの状態の最新値
+// Heightの単位は0.1m, Speedの単位は0.1m/s
+type Telemetry struct {
+	Battery       int       `json:"battery"`
+	Height        int       `json:"height"`
+	WifiStrength  int       `json:"wifiStrength"`
+	Flying        bool      `json:"flying"`
+	NorthSpeed    int       `json:"northSpeed"`
+	EastSpeed     int       `json:"eastSpeed"`
+	VerticalSpeed int       `json:"verticalSpeed"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+	Odometry      Odometry  `json:"odometry"`
+	// [mission]がenableの時だけ
+	MissionPad *MissionPad `json:"missionPad,omitempty"`
+}
+
+type telemetryStore struct {
+	mu        sync.RWMutex
+	telemetry Telemetry
+}
+
+func (t *telemetryStore) updateFlightData(fd *tello.FlightData) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.telemetry.Battery = int(fd.BatteryPercentage)
+	t.telemetry.Height = int(fd.Height)
+	t.telemetry.Flying = fd.Flying
+	t.telemetry.NorthSpeed = int(fd.NorthSpeed)
+	t.telemetry.EastSpeed = int(fd.EastSpeed)
+	t.telemetry.VerticalSpeed = int(fd.VerticalSpeed)
+	t.telemetry.UpdatedAt = time.Now()
+}
+
+func (t *telemetryStore) updateWifiData(wd *tello.WifiData) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.telemetry.WifiStrength = int(wd.Strength)
+	t.telemetry.UpdatedAt = time.Now()
+}
+
+func (t *telemetryStore) get() Telemetry {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.telemetry
+}
@@ -0,0 +1,196 @@
+package models
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+const (
+	// H.264 NALユニットの種類
+	nalTypeNonIDR = 1
+	nalTypeIDR    = 5
+	nalTypeSPS    = 7
+	// TelloのH.264は約30fps
+	defaultFrameDuration = time.Second / 30
+	// スタートコードが来ないまま溜まったら捨てる。Telloのフレームは大きくても数百KB
+	maxNALBuffer = 1 << 20
+	// STUNサーバーが返事をしない時に待ち続けないように。集まった分のcandidateで返す
+	iceGatherTimeout = 5 * time.Second
+)
+
+// 3バイトのスタートコード。4バイトの00 00 00 01は前に0が付いたもの
+var annexBStartCode = []byte{0, 0, 1}
+
+// from以降で最初のスタートコードの位置と長さ(3か4)。無ければ-1
+func findStartCode(buf []byte, from int) (int, int) {
+	i := bytes.Index(buf[from:], annexBStartCode)
+	if i < 0 {
+		return -1, 0
+	}
+	i += from
+	if i > from && buf[i-1] == 0 {
+		return i - 1, 4
+	}
+	return i, 3
+}
+
+// WebRTCでTelloのH.264をデコードせずにブラウザへ流す。
+// MJPEGのようにffmpegを通らないので、遅延が少ない。
+// TrackLocalStaticSampleは複数のPeerConnectionで共有できるので、trackは１つだけ。
+type WebRTCPublisher struct {
+	peers     int64
+	mu        sync.Mutex
+	track     *webrtc.TrackLocalStaticSample
+	config    webrtc.Configuration
+	buf       []byte
+	frame     []byte
+	lastFrame time.Time
+}
+
+func NewWebRTCPublisher(stunServer string) (*WebRTCPublisher, error) {
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "tello")
+	if err != nil {
+		return nil, err
+	}
+	// 同じWifi内ならhost candidateだけで繋がるので、STUNは任意
+	config := webrtc.Configuration{}
+	if stunServer != "" {
+		config.ICEServers = []webrtc.ICEServer{{URLs: []string{stunServer}}}
+	}
+	return &WebRTCPublisher{track: track, config: config}, nil
+}
+
+// VideoFrameEventのパケットはNALユニットの途中で区切られているので、
+// スタートコードで分割してフレーム（アクセスユニット）毎にtrackへ書き込む。
+func (p *WebRTCPublisher) WritePacket(pkt []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buf = append(p.buf, pkt...)
+	if len(p.buf)+len(p.frame) > maxNALBuffer {
+		log.Printf("action=WebRTCPublisher.WritePacket err=no start code in %d bytes, dropped", len(p.buf)+len(p.frame))
+		p.buf, p.frame = nil, nil
+		return
+	}
+	for {
+		start, n := findStartCode(p.buf, 0)
+		if start < 0 {
+			// スタートコードの途中で区切られているかもしれないので、最後の2バイトだけ残す
+			if len(p.buf) > 2 {
+				p.buf = p.buf[len(p.buf)-2:]
+			}
+			return
+		}
+		// 最初のスタートコードより前のゴミは捨てる
+		p.buf = p.buf[start:]
+		// 先頭のスタートコードの次から、次のスタートコードまでが１つのNAL
+		next, _ := findStartCode(p.buf, n)
+		if next < 0 {
+			return
+		}
+		nal := p.buf[:next]
+		p.buf = p.buf[next:]
+		if len(nal) <= n {
+			continue
+		}
+		p.frame = append(p.frame, nal...)
+
+		// SPS, PPSは次のフレームと一緒に送る
+		nalType := nal[n] & 0x1f
+		if nalType != nalTypeIDR && nalType != nalTypeNonIDR {
+			continue
+		}
+		p.writeFrame()
+	}
+}
+
+func (p *WebRTCPublisher) writeFrame() {
+	now := time.Now()
+	duration := defaultFrameDuration
+	if !p.lastFrame.IsZero() {
+		duration = now.Sub(p.lastFrame)
+	}
+	p.lastFrame = now
+
+	if err := p.track.WriteSample(media.Sample{Data: p.frame, Duration: duration}); err != nil {
+		log.Printf("action=WebRTCPublisher.writeFrame err=%s", err.Error())
+	}
+	p.frame = nil
+}
+
+// 接続中のブラウザの数
+func (p *WebRTCPublisher) Peers() int {
+	return int(atomic.LoadInt64(&p.peers))
+}
+
+// ブラウザからのSDP offerを受け取り、answerを返す。
+// ICE candidateを全部集めてから返すので、Trickle ICE用のエンドポイントは不要。
+// 集まらない時はiceGatherTimeoutで諦める。
+func (p *WebRTCPublisher) Answer(offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	pc, err := webrtc.NewPeerConnection(p.config)
+	if err != nil {
+		return nil, err
+	}
+
+	sender, err := pc.AddTrack(p.track)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	// RTCPを読まないとinterceptorが詰まる
+	go func() {
+		rtcpBuf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(rtcpBuf); err != nil {
+				return
+			}
+		}
+	}()
+
+	var connected int32
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("action=WebRTCPublisher state=%s", state.String())
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			if atomic.CompareAndSwapInt32(&connected, 0, 1) {
+				atomic.AddInt64(&p.peers, 1)
+			}
+		case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			if atomic.CompareAndSwapInt32(&connected, 1, 0) {
+				atomic.AddInt64(&p.peers, -1)
+			}
+			if state != webrtc.PeerConnectionStateDisconnected {
+				pc.Close()
+			}
+		}
+	})
+
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	select {
+	case <-gatherComplete:
+	case <-time.After(iceGatherTimeout):
+		log.Printf("action=WebRTCPublisher.Answer err=ICE gathering timed out, answer with the candidates gathered so far")
+	}
+
+	return pc.LocalDescription(), nil
+}
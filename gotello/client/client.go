@@ -0,0 +1,632 @@
+// gotelloのWebサーバーを操作するためのクライアント。
+// api/openapi.yamlの /api/v1/ と、テレメトリ・ビデオのエンドポイントを型付きのメソッドで呼べる。
+// gocv等に依存しないように、レスポンスの型はmodelsを使わずにここで定義する。
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tokenはconfig.iniの[tokens]に登録したAPIのtoken。認証しないサーバーなら空でいい
+// Leaseは操縦権のID。AcquireLease等が入れて、X-Pilot-Leaseヘッダーで送る
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	Token      string
+	Lease      string
+}
+
+// baseURLは http://192.168.10.2:8080 のようにする
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// サーバーが返したエラー。/api/v1/ 以外ではCodeとFieldは空になる
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Field      string
+}
+
+func (e *Error) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("gotello: %d %s: %s (%s)", e.StatusCode, e.Code, e.Message, e.Field)
+	}
+	return fmt.Sprintf("gotello: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+type Telemetry struct {
+	Battery       int       `json:"battery"`
+	Height        int       `json:"height"`
+	WifiStrength  int       `json:"wifiStrength"`
+	Flying        bool      `json:"flying"`
+	NorthSpeed    int       `json:"northSpeed"`
+	EastSpeed     int       `json:"eastSpeed"`
+	VerticalSpeed int       `json:"verticalSpeed"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+	Odometry      Odometry  `json:"odometry"`
+	// mission padが有効な時だけ
+	MissionPad *MissionPad `json:"missionPad,omitempty"`
+}
+
+// IDは1-8で、見えていなければ-1。X, Y, Zはpadからの位置(cm)
+type MissionPad struct {
+	ID        int       `json:"id"`
+	Detected  bool      `json:"detected"`
+	X         int       `json:"x"`
+	Y         int       `json:"y"`
+	Z         int       `json:"z"`
+	Yaw       int       `json:"yaw"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// padを基準にした位置(cm)へ飛ぶ。JumpToがあればjump
+type MissionStep struct {
+	Pad    int `json:"pad"`
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Z      int `json:"z"`
+	Speed  int `json:"speed"`
+	JumpTo int `json:"jumpTo,omitempty"`
+	Yaw    int `json:"yaw,omitempty"`
+}
+
+// Repeatが0なら止めるまで繰り返す
+type Mission struct {
+	Steps  []MissionStep `json:"steps"`
+	Repeat int           `json:"repeat"`
+}
+
+type MissionStatus struct {
+	Enabled bool       `json:"enabled"`
+	Running bool       `json:"running"`
+	Step    int        `json:"step"`
+	Round   int        `json:"round"`
+	Error   string     `json:"error,omitempty"`
+	Pad     MissionPad `json:"pad"`
+}
+
+// 離陸した場所からの推定の位置。yawは離陸した時の向きから時計回りの角度(度)
+type Odometry struct {
+	Position Position `json:"position"`
+	Velocity Position `json:"velocity"`
+	Yaw      float64  `json:"yaw"`
+	Distance float64  `json:"distance"`
+}
+
+type DecoderHealth struct {
+	Running     bool      `json:"running"`
+	HWAccel     bool      `json:"hwaccel"`
+	FPS         float64   `json:"fps"`
+	Frames      int       `json:"frames"`
+	Restarts    int       `json:"restarts"`
+	LastError   string    `json:"lastError"`
+	LastErrorAt time.Time `json:"lastErrorAt"`
+	LastFrameAt time.Time `json:"lastFrameAt"`
+}
+
+type Histogram struct {
+	Buckets    []float64 `json:"buckets"`
+	Cumulative []uint64  `json:"cumulative"`
+	Count      uint64    `json:"count"`
+	Sum        float64   `json:"sum"`
+	MeanMs     float64   `json:"meanMs"`
+	LastMs     float64   `json:"lastMs"`
+}
+
+type VideoMetrics struct {
+	PacketsIn       uint64               `json:"packetsIn"`
+	BytesIn         uint64               `json:"bytesIn"`
+	FramesDecoded   uint64               `json:"framesDecoded"`
+	DecodeErrors    uint64               `json:"decodeErrors"`
+	FramesDetected  uint64               `json:"framesDetected"`
+	FramesPublished uint64               `json:"framesPublished"`
+	PublishFPS      float64              `json:"publishFps"`
+	Stages          map[string]Histogram `json:"stages"`
+}
+
+type VideoSettings struct {
+	Streaming bool   `json:"streaming"`
+	Bitrate   string `json:"bitrate"`
+	Exposure  int    `json:"exposure"`
+	Mode      string `json:"mode"`
+}
+
+type EmergencyState struct {
+	Latched   bool      `json:"latched"`
+	LatchedAt time.Time `json:"latchedAt"`
+}
+
+// modeは disconnected, grounded, takingOff, manual, patrol, tracking, mission, returnHome, landing, emergency
+type StateEvent struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+type FlightState struct {
+	Mode   string       `json:"mode"`
+	Since  time.Time    `json:"since"`
+	Events []StateEvent `json:"events"`
+}
+
+// statusは ok, error, preempted
+type CommandResult struct {
+	Name     string        `json:"name"`
+	Priority string        `json:"priority"`
+	Status   string        `json:"status"`
+	Error    string        `json:"error"`
+	QueuedAt time.Time     `json:"queuedAt"`
+	Wait     time.Duration `json:"waitNs"`
+	Duration time.Duration `json:"durationNs"`
+}
+
+type CommandQueue struct {
+	Pending int             `json:"pending"`
+	Recent  []CommandResult `json:"recent"`
+}
+
+// 離陸した場所からの位置(m)。yは離陸した時の前, xは右, zは高さ
+type Position struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+type GeofenceStatus struct {
+	Enabled   bool     `json:"enabled"`
+	Position  Position `json:"position"`
+	Velocity  Position `json:"velocity"`
+	Distance  float64  `json:"distance"`
+	Radius    float64  `json:"radius"`
+	MaxHeight float64  `json:"maxHeight"`
+	Breached  bool     `json:"breached"`
+}
+
+type Resolution struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Directionは up, down, forward, backward, left, right, clockwise, counterClockwise
+// Speedが0の場合はサーバーのSpeedを使う。DurationMsが0の場合はHoverするまで動き続ける
+type MoveRequest struct {
+	Direction  string `json:"direction"`
+	Speed      int    `json:"speed,omitempty"`
+	DurationMs int    `json:"durationMs,omitempty"`
+}
+
+// -100..100。roll: 右, pitch: 前, throttle: 上, yaw: 時計回りが+
+type Sticks struct {
+	Roll     int `json:"roll"`
+	Pitch    int `json:"pitch"`
+	Throttle int `json:"throttle"`
+	Yaw      int `json:"yaw"`
+}
+
+type AxisMapping struct {
+	Axis     int     `json:"axis"`
+	Invert   bool    `json:"invert"`
+	Deadzone float64 `json:"deadzone"`
+	Expo     float64 `json:"expo"`
+}
+
+// Axesのキーは roll, pitch, throttle, yaw。Buttonsはボタンの番号とコマンド
+type GamepadProfile struct {
+	Axes    map[string]AxisMapping `json:"axes"`
+	Buttons map[int]string         `json:"buttons"`
+}
+
+// Keysのキーは KeyboardEvent.code、値は移動(forward等)かコマンド
+type KeyboardProfile struct {
+	Keys map[string]string `json:"keys"`
+}
+
+const (
+	FlipFront = "front"
+	FlipBack  = "back"
+	FlipLeft  = "left"
+	FlipRight = "right"
+)
+
+type apiResult struct {
+	Result json.RawMessage `json:"result"`
+	Code   int             `json:"code"`
+	Error  *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+		Field   string `json:"field"`
+	} `json:"error"`
+}
+
+// bodyがio.Readerでない場合はJsonにして送る。resultがnilでなければresultをデコードする
+func (c *Client) do(ctx context.Context, method, path string, body interface{}, contentType string, result interface{}) error {
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		reader = b
+	default:
+		js, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(js)
+		contentType = "application/json"
+	}
+
+	req, err := http.NewRequest(method, c.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.Lease != "" {
+		req.Header.Set("X-Pilot-Lease", c.Lease)
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var r apiResult
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return &Error{StatusCode: res.StatusCode, Message: err.Error()}
+	}
+	if res.StatusCode != http.StatusOK {
+		apiErr := &Error{StatusCode: res.StatusCode}
+		if r.Error != nil {
+			apiErr.Code, apiErr.Message, apiErr.Field = r.Error.Code, r.Error.Message, r.Error.Field
+		} else {
+			// 古いエンドポイントはresultにメッセージが入る
+			json.Unmarshal(r.Result, &apiErr.Message)
+		}
+		return apiErr
+	}
+	if result != nil {
+		return json.Unmarshal(r.Result, result)
+	}
+	return nil
+}
+
+func (c *Client) post(ctx context.Context, path string, body interface{}) error {
+	return c.do(ctx, http.MethodPost, path, body, "", nil)
+}
+
+func (c *Client) postForm(ctx context.Context, path string, form url.Values, result interface{}) error {
+	return c.do(ctx, http.MethodPost, path, strings.NewReader(form.Encode()), "application/x-www-form-urlencoded", result)
+}
+
+func (c *Client) put(ctx context.Context, path string, body interface{}) error {
+	return c.do(ctx, http.MethodPut, path, body, "", nil)
+}
+
+func (c *Client) get(ctx context.Context, path string, result interface{}) error {
+	return c.do(ctx, http.MethodGet, path, nil, "", result)
+}
+
+func (c *Client) TakeOff(ctx context.Context) error {
+	return c.post(ctx, "/api/v1/takeoff", nil)
+}
+
+func (c *Client) ThrowTakeOff(ctx context.Context) error {
+	return c.post(ctx, "/api/v1/takeoff", map[string]bool{"throw": true})
+}
+
+func (c *Client) Land(ctx context.Context) error {
+	return c.post(ctx, "/api/v1/land", nil)
+}
+
+// 離陸した場所に戻って着陸する。すぐに返り、戻っている間はStateのmodeがreturnHomeになる
+func (c *Client) ReturnHome(ctx context.Context) error {
+	return c.post(ctx, "/api/v1/return-home", nil)
+}
+
+func (c *Client) Hover(ctx context.Context) error {
+	return c.post(ctx, "/api/v1/hover", nil)
+}
+
+func (c *Client) CeaseRotation(ctx context.Context) error {
+	return c.post(ctx, "/api/v1/cease-rotation", nil)
+}
+
+func (c *Client) Move(ctx context.Context, req MoveRequest) error {
+	return c.post(ctx, "/api/v1/move", req)
+}
+
+// directionはFlipFront等
+func (c *Client) Flip(ctx context.Context, direction string) error {
+	return c.post(ctx, "/api/v1/flip", map[string]string{"direction": direction})
+}
+
+// 10~50Hzで送り続ける。送るのをやめるとサーバーが0に戻す
+func (c *Client) RC(ctx context.Context, sticks Sticks) error {
+	return c.post(ctx, "/api/v1/rc", sticks)
+}
+
+// 保存されていない場合はデフォルトの割り当てが返る
+func (c *Client) GamepadProfile(ctx context.Context, profile string) (*GamepadProfile, error) {
+	var g GamepadProfile
+	if err := c.get(ctx, "/api/v1/profiles/"+url.PathEscape(profile)+"/gamepad", &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (c *Client) SetGamepadProfile(ctx context.Context, profile string, g GamepadProfile) error {
+	return c.put(ctx, "/api/v1/profiles/"+url.PathEscape(profile)+"/gamepad", g)
+}
+
+// 保存されていない場合はデフォルトの割り当て(WASD)が返る
+func (c *Client) KeyboardProfile(ctx context.Context, profile string) (*KeyboardProfile, error) {
+	var k KeyboardProfile
+	if err := c.get(ctx, "/api/v1/profiles/"+url.PathEscape(profile)+"/keyboard", &k); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func (c *Client) SetKeyboardProfile(ctx context.Context, profile string, k KeyboardProfile) error {
+	return c.put(ctx, "/api/v1/profiles/"+url.PathEscape(profile)+"/keyboard", k)
+}
+
+// モーターをすぐに止める。Rearmするまで離陸や移動はエラーになる
+func (c *Client) Emergency(ctx context.Context) error {
+	return c.post(ctx, "/api/v1/emergency", nil)
+}
+
+func (c *Client) Rearm(ctx context.Context) error {
+	return c.post(ctx, "/api/v1/emergency/rearm", nil)
+}
+
+func (c *Client) EmergencyState(ctx context.Context) (*EmergencyState, error) {
+	var e EmergencyState
+	if err := c.get(ctx, "/api/v1/emergency", &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (c *Client) Bounce(ctx context.Context) error {
+	return c.post(ctx, "/api/v1/bounce", nil)
+}
+
+func (c *Client) SetSpeed(ctx context.Context, speed int) error {
+	return c.put(ctx, "/api/v1/speed", map[string]int{"speed": speed})
+}
+
+func (c *Client) SetPatrol(ctx context.Context, enabled bool) error {
+	return c.put(ctx, "/api/v1/patrol", map[string]bool{"enabled": enabled})
+}
+
+func (c *Client) SetTracking(ctx context.Context, enabled bool) error {
+	return c.put(ctx, "/api/v1/tracking", map[string]bool{"enabled": enabled})
+}
+
+func (c *Client) SetHUD(ctx context.Context, enabled bool) error {
+	return c.put(ctx, "/api/v1/hud", map[string]bool{"enabled": enabled})
+}
+
+// 保存したスナップショットのURLを返す
+func (c *Client) Snapshot(ctx context.Context) (string, error) {
+	var path string
+	if err := c.do(ctx, http.MethodPost, "/api/v1/snapshot", nil, "", &path); err != nil {
+		return "", err
+	}
+	return c.BaseURL + path, nil
+}
+
+func (c *Client) Commands(ctx context.Context) (*CommandQueue, error) {
+	var q CommandQueue
+	if err := c.get(ctx, "/api/v1/commands", &q); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+func (c *Client) Geofence(ctx context.Context) (*GeofenceStatus, error) {
+	var g GeofenceStatus
+	if err := c.get(ctx, "/api/v1/geofence", &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (c *Client) Mission(ctx context.Context) (*MissionStatus, error) {
+	var m MissionStatus
+	if err := c.get(ctx, "/api/v1/mission", &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (c *Client) StartMission(ctx context.Context, mission Mission) (*MissionStatus, error) {
+	var m MissionStatus
+	if err := c.do(ctx, http.MethodPut, "/api/v1/mission", mission, "", &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (c *Client) StopMission(ctx context.Context) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/mission", nil, "", nil)
+}
+
+// tokenの名前とrole(viewer, pilot, admin)
+type Me struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+func (c *Client) Me(ctx context.Context) (*Me, error) {
+	var m Me
+	if err := c.get(ctx, "/api/v1/me", &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// 操縦権。IDは自分が持っているか、requestした時だけ入る
+type LeaseStatus struct {
+	Enabled     bool      `json:"enabled"`
+	Held        bool      `json:"held"`
+	Holder      string    `json:"holder"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	Yours       bool      `json:"yours"`
+	RequestedBy string    `json:"requestedBy"`
+	ID          string    `json:"id"`
+}
+
+// c.LeaseのIDで呼び、返ったIDをc.Leaseに入れる
+func (c *Client) lease(ctx context.Context, method, path string) (*LeaseStatus, error) {
+	var l LeaseStatus
+	if err := c.do(ctx, method, "/api/v1/lease"+path, nil, "", &l); err != nil {
+		return nil, err
+	}
+	c.Lease = l.ID
+	return &l, nil
+}
+
+// handoverされたかを調べるのにも使う
+func (c *Client) LeaseStatus(ctx context.Context) (*LeaseStatus, error) {
+	return c.lease(ctx, http.MethodGet, "")
+}
+
+// 取るか延長する。他の人が持っていればCodeがlease_heldのError
+func (c *Client) AcquireLease(ctx context.Context) (*LeaseStatus, error) {
+	return c.lease(ctx, http.MethodPost, "")
+}
+
+func (c *Client) ReleaseLease(ctx context.Context) error {
+	_, err := c.lease(ctx, http.MethodDelete, "")
+	return err
+}
+
+func (c *Client) RequestLease(ctx context.Context) (*LeaseStatus, error) {
+	return c.lease(ctx, http.MethodPost, "/request")
+}
+
+func (c *Client) HandoverLease(ctx context.Context) (*LeaseStatus, error) {
+	return c.lease(ctx, http.MethodPost, "/handover")
+}
+
+// adminだけ
+func (c *Client) OverrideLease(ctx context.Context) (*LeaseStatus, error) {
+	return c.lease(ctx, http.MethodPost, "/override")
+}
+
+func (c *Client) Telemetry(ctx context.Context) (*Telemetry, error) {
+	var t Telemetry
+	if err := c.get(ctx, "/api/v1/telemetry", &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (c *Client) State(ctx context.Context) (*FlightState, error) {
+	var s FlightState
+	if err := c.get(ctx, "/api/state", &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (c *Client) VideoHealth(ctx context.Context) (*DecoderHealth, error) {
+	var h DecoderHealth
+	if err := c.get(ctx, "/api/video/health", &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func (c *Client) VideoMetrics(ctx context.Context) (*VideoMetrics, error) {
+	var m VideoMetrics
+	if err := c.get(ctx, "/api/video/metrics", &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// formatは hls か rtsp。width, heightが0の場合はサーバーのconfigの解像度
+// hlsの場合はプレイリストのURLを返す
+func (c *Client) StartRestream(ctx context.Context, format string, width, height int) (string, error) {
+	form := url.Values{"format": {format}}
+	if width > 0 && height > 0 {
+		form.Set("width", strconv.Itoa(width))
+		form.Set("height", strconv.Itoa(height))
+	}
+	var result string
+	if err := c.postForm(ctx, "/api/restream/start", form, &result); err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(result, "/") {
+		return c.BaseURL + result, nil
+	}
+	return result, nil
+}
+
+func (c *Client) StopRestream(ctx context.Context, format string) error {
+	return c.postForm(ctx, "/api/restream/stop", url.Values{"format": {format}}, nil)
+}
+
+// 配信中のフォーマットと解像度
+func (c *Client) Restreams(ctx context.Context) (map[string]Resolution, error) {
+	status := map[string]Resolution{}
+	if err := c.get(ctx, "/api/restream/", &status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// amplitude: スピード, count: 往復の回数, intervalMs: 片道の時間
+func (c *Client) Shake(ctx context.Context, amplitude, count, intervalMs int) error {
+	form := url.Values{
+		"amplitude": {strconv.Itoa(amplitude)},
+		"count":     {strconv.Itoa(count)},
+		"interval":  {strconv.Itoa(intervalMs)},
+	}
+	return c.postForm(ctx, "/api/shake", form, nil)
+}
+
+func (c *Client) VideoSettings(ctx context.Context) (*VideoSettings, error) {
+	var v VideoSettings
+	if err := c.get(ctx, "/api/video", &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// streaming, bitrate, exposure, modeの中で変更したいものだけを入れる
+// 例: url.Values{"bitrate": {"2M"}, "mode": {"wide"}}
+func (c *Client) UpdateVideoSettings(ctx context.Context, settings url.Values) (*VideoSettings, error) {
+	var v VideoSettings
+	if err := c.postForm(ctx, "/api/video", settings, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func (c *Client) MJPEGStreamURL() string {
+	return c.BaseURL + "/video/streaming"
+}
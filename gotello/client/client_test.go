@@ -0,0 +1,148 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"gobot.io/x/gobot/platforms/dji/tello"
+
+	"github.com/roy1210/Study/Go-drone/gotello/app/controllers"
+	"github.com/roy1210/Study/Go-drone/gotello/app/models"
+	"github.com/roy1210/Study/Go-drone/gotello/config"
+)
+
+const testToken = "test-token"
+
+// ドローンの代わりに、呼ばれたコマンドを記録する。
+// テストで使わないメソッドは埋め込んだnilのDriverで、呼ばれたらpanicする
+type fakeDriver struct {
+	models.Driver
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *fakeDriver) record(call string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+	return nil
+}
+
+func (f *fakeDriver) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func (f *fakeDriver) TakeOff() error        { return f.record("takeOff") }
+func (f *fakeDriver) Forward(val int) error { return f.record(fmt.Sprintf("forward %d", val)) }
+func (f *fakeDriver) BackFlip() error       { return f.record("backFlip") }
+
+// 本物の/api/v1/のハンドラーを、偽物のDriverのDroneManagerで動かす。
+// 認証とleaseはconfig.iniに関係なく有効にして、tokenはpilotにする
+func newTestServer(t *testing.T) (*Client, *fakeDriver) {
+	t.Helper()
+	sum := sha256.Sum256([]byte(testToken))
+	config.Config.AuthEnable = true
+	config.Config.AuthTokens = map[string]string{"test": "pilot:" + hex.EncodeToString(sum[:])}
+	config.Config.AuthUsers = map[string]string{}
+	config.Config.LeaseEnable = true
+
+	driver := &fakeDriver{}
+	drone := models.NewDroneManagerWithDriver(driver)
+	// 接続して地上にいる状態にする
+	drone.UpdateFlightData(&tello.FlightData{})
+
+	handler, err := controllers.NewHandler(drone)
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	c := New(server.URL)
+	c.Token = testToken
+	return c, driver
+}
+
+// サーバーが返したエラーのbodyがErrorに入っているか
+func assertAPIError(t *testing.T, err error, status int, code, field string) {
+	t.Helper()
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want *Error", err)
+	}
+	if apiErr.StatusCode != status || apiErr.Code != code || apiErr.Field != field || apiErr.Message == "" {
+		t.Fatalf("err = %+v, want status=%d code=%s field=%q with a message", apiErr, status, code, field)
+	}
+}
+
+func TestTakeOffMoveFlip(t *testing.T) {
+	c, driver := newTestServer(t)
+	ctx := context.Background()
+
+	lease, err := c.AcquireLease(ctx)
+	if err != nil {
+		t.Fatalf("AcquireLease: %v", err)
+	}
+	if !lease.Yours || c.Lease == "" {
+		t.Fatalf("lease = %+v, want yours with an id", lease)
+	}
+	if err := c.TakeOff(ctx); err != nil {
+		t.Fatalf("TakeOff: %v", err)
+	}
+	if err := c.Move(ctx, MoveRequest{Direction: "forward", Speed: 20}); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if err := c.Flip(ctx, FlipBack); err != nil {
+		t.Fatalf("Flip: %v", err)
+	}
+
+	want := []string{"takeOff", "forward 20", "backFlip"}
+	if got := driver.Calls(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("driver calls = %v, want %v", got, want)
+	}
+	state, err := c.State(ctx)
+	if err != nil {
+		t.Fatalf("State: %v", err)
+	}
+	if state.Mode != "takingOff" {
+		t.Fatalf("mode = %s, want takingOff", state.Mode)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	c, driver := newTestServer(t)
+	ctx := context.Background()
+
+	// leaseを取る前は409
+	assertAPIError(t, c.TakeOff(ctx), http.StatusConflict, "lease_required", "")
+
+	if _, err := c.AcquireLease(ctx); err != nil {
+		t.Fatalf("AcquireLease: %v", err)
+	}
+	assertAPIError(t, c.Move(ctx, MoveRequest{Direction: "sideways"}), http.StatusBadRequest, "invalid_argument", "direction")
+	assertAPIError(t, c.Flip(ctx, "up"), http.StatusBadRequest, "invalid_argument", "direction")
+
+	// 離陸中はpatrolにできない
+	if err := c.TakeOff(ctx); err != nil {
+		t.Fatalf("TakeOff: %v", err)
+	}
+	assertAPIError(t, c.SetPatrol(ctx, true), http.StatusConflict, "invalid_transition", "")
+
+	// tokenが無ければ401
+	anonymous := New(c.BaseURL)
+	assertAPIError(t, anonymous.TakeOff(ctx), http.StatusUnauthorized, "unauthorized", "")
+
+	if got := driver.Calls(); !reflect.DeepEqual(got, []string{"takeOff"}) {
+		t.Fatalf("driver calls = %v, want only takeOff", got)
+	}
+}
@@ -3,28 +3,173 @@ package config
 import (
 	"log"
 	"os"
+	"path/filepath"
 
 	"gopkg.in/ini.v1"
 )
 
 type ConfList struct {
-	LogFile string
-	Address string
-	Port    int
+	LogFile          string
+	Address          string
+	Port             int
+	WebRTCEnable     bool
+	WebRTCStunServer string
+	RestreamHLSDir   string
+	RestreamRTSPURL  string
+	RestreamWidth    int
+	RestreamHeight   int
+	// デコード後のフレーム。重くならないように小さくする。
+	VideoDecoder       string
+	VideoGoCVUDPPort   int
+	VideoWidth         int
+	VideoHeight        int
+	VideoPixFmt        string
+	VideoHWAccel       string
+	VideoHWAccelDevice string
+	VideoJPEGQuality   int
+	// 最初のカメラの設定。APIで変更した設定はCameraStateFileに保存して、次からはそちらを使う
+	CameraBitrate   string
+	CameraExposure  int
+	CameraVideoMode string
+	CameraStateFile string
+	RCTimeoutMs     int
+	RCSmoothing     float64
+	ProfilesDir     string
+	// 室内で壁にぶつからないように、離陸した場所からの距離と高さを制限する
+	GeofenceEnable    bool
+	GeofenceRadius    float64
+	GeofenceMaxHeight float64
+	// スティックを最大にした時の1秒の回転(度)。向きの推定に使う
+	OdometryYawRate float64
+	ReturnHomeSpeed int
+	// mission padはTello EDUだけ。SDKのテキストコマンドを使う
+	MissionEnable    bool
+	MissionStatePort int
+	MissionDirection int
+	// ログインしないと使えないようにする。usersは 名前 = role:bcryptのhash,
+	// tokensは 名前 = role:tokenのsha256(hex)。roleは viewer, pilot, admin
+	AuthEnable       bool
+	AuthSessionHours int
+	AuthUsers        map[string]string
+	AuthTokens       map[string]string
+	// 1人だけが操縦できるようにする。timeoutの間コマンドが来なければ他の人が取れる
+	LeaseEnable  bool
+	LeaseTimeout int
+	// [web]のHTTPSとセキュリティ。証明書と鍵が無ければ最初の起動で自己署名の証明書を作る
+	TLSEnable       bool
+	TLSCertFile     string
+	TLSKeyFile      string
+	CSRFEnable      bool
+	SecurityHeaders bool
+	CSP             string
+	HSTSSeconds     int
 }
 
+const configFile = "config.ini"
+
 var Config ConfList
 
+// 今のフォルダから親のフォルダへconfig.iniを探す。
+// go testはパッケージのフォルダで実行されるので、gotelloのフォルダまで上る
+func findConfigFile() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return configFile
+	}
+	for {
+		path := filepath.Join(dir, configFile)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return configFile
+		}
+		dir = parent
+	}
+}
+
 func init() {
-	cfg, err := ini.Load("config.ini")
+	cfg, err := ini.Load(findConfigFile())
 	if err != nil {
 		log.Printf("Failed to read file: %v", err)
 		os.Exit(1)
 	}
 
 	Config = ConfList{
-		LogFile: cfg.Section("gotello").Key("log_file").String(),
-		Address: cfg.Section("web").Key("address").String(),
-		Port:    cfg.Section("web").Key("port").MustInt(),
+		LogFile:            cfg.Section("gotello").Key("log_file").String(),
+		Address:            cfg.Section("web").Key("address").String(),
+		Port:               cfg.Section("web").Key("port").MustInt(),
+		WebRTCEnable:       cfg.Section("webrtc").Key("enable").MustBool(true),
+		WebRTCStunServer:   cfg.Section("webrtc").Key("stun_server").String(),
+		RestreamHLSDir:     cfg.Section("restream").Key("hls_dir").MustString("static/hls"),
+		RestreamRTSPURL:    cfg.Section("restream").Key("rtsp_url").String(),
+		RestreamWidth:      cfg.Section("restream").Key("width").MustInt(640),
+		RestreamHeight:     cfg.Section("restream").Key("height").MustInt(480),
+		VideoDecoder:       cfg.Section("video").Key("decoder").MustString("ffmpeg"),
+		VideoGoCVUDPPort:   cfg.Section("video").Key("gocv_udp_port").MustInt(11112),
+		VideoWidth:         cfg.Section("video").Key("width").MustInt(960 / 3),
+		VideoHeight:        cfg.Section("video").Key("height").MustInt(720 / 3),
+		VideoPixFmt:        cfg.Section("video").Key("pix_fmt").MustString("bgr24"),
+		VideoHWAccel:       cfg.Section("video").Key("hwaccel").String(),
+		VideoHWAccelDevice: cfg.Section("video").Key("hwaccel_device").String(),
+		VideoJPEGQuality:   cfg.Section("video").Key("jpeg_quality").MustInt(95),
+		CameraBitrate:      cfg.Section("camera").Key("bitrate").MustString("auto"),
+		CameraExposure:     cfg.Section("camera").Key("exposure").MustInt(0),
+		CameraVideoMode:    cfg.Section("camera").Key("video_mode").MustString("narrow"),
+		CameraStateFile:    cfg.Section("camera").Key("state_file").MustString("camera.json"),
+		RCTimeoutMs:        cfg.Section("rc").Key("timeout_ms").MustInt(500),
+		RCSmoothing:        cfg.Section("rc").Key("smoothing").MustFloat64(0.3),
+		ProfilesDir:        cfg.Section("profiles").Key("dir").MustString("profiles"),
+		GeofenceEnable:     cfg.Section("geofence").Key("enable").MustBool(true),
+		GeofenceRadius:     cfg.Section("geofence").Key("radius_m").MustFloat64(3),
+		GeofenceMaxHeight:  cfg.Section("geofence").Key("max_height_m").MustFloat64(2),
+		OdometryYawRate:    cfg.Section("odometry").Key("yaw_rate").MustFloat64(100),
+		ReturnHomeSpeed:    cfg.Section("odometry").Key("return_home_speed").MustInt(30),
+		MissionEnable:      cfg.Section("mission").Key("enable").MustBool(false),
+		MissionStatePort:   cfg.Section("mission").Key("state_port").MustInt(8890),
+		MissionDirection:   cfg.Section("mission").Key("direction").MustInt(0),
+		AuthEnable:         cfg.Section("auth").Key("enable").MustBool(true),
+		AuthSessionHours:   cfg.Section("auth").Key("session_hours").MustInt(12),
+		AuthUsers:          cfg.Section("users").KeysHash(),
+		AuthTokens:         cfg.Section("tokens").KeysHash(),
+		LeaseEnable:        cfg.Section("lease").Key("enable").MustBool(true),
+		LeaseTimeout:       cfg.Section("lease").Key("timeout_s").MustInt(30),
+		TLSEnable:          cfg.Section("web").Key("tls").MustBool(false),
+		TLSCertFile:        cfg.Section("web").Key("cert_file").MustString("tls/cert.pem"),
+		TLSKeyFile:         cfg.Section("web").Key("key_file").MustString("tls/key.pem"),
+		CSRFEnable:         cfg.Section("web").Key("csrf").MustBool(true),
+		SecurityHeaders:    cfg.Section("web").Key("security_headers").MustBool(true),
+		CSP:                cfg.Section("web").Key("content_security_policy").String(),
+		HSTSSeconds:        cfg.Section("web").Key("hsts_seconds").MustInt(0),
+	}
+	if errs := Config.validate(); len(errs) > 0 {
+		for _, e := range errs {
+			log.Printf("Invalid %s: %s", configFile, e)
+		}
+		os.Exit(1)
+	}
+}
+
+// ffmpegやドローンに渡してから失敗しないように、起動時に値を確かめる
+func (c ConfList) validate() []string {
+	var errs []string
+	// H.264とyuv420pは幅と高さが偶数でないと扱えない
+	if c.VideoWidth <= 0 || c.VideoHeight <= 0 || c.VideoWidth%2 != 0 || c.VideoHeight%2 != 0 {
+		errs = append(errs, "[video] width and height must be positive even numbers")
+	}
+	if c.RestreamWidth <= 0 || c.RestreamHeight <= 0 || c.RestreamWidth%2 != 0 || c.RestreamHeight%2 != 0 {
+		errs = append(errs, "[restream] width and height must be positive even numbers")
+	}
+	if c.VideoPixFmt != "bgr24" && c.VideoPixFmt != "gray" {
+		errs = append(errs, "[video] pix_fmt must be bgr24 or gray")
+	}
+	// 11111はTelloがビデオを送ってきて、gobotが受けているポート
+	if c.VideoGoCVUDPPort < 1 || c.VideoGoCVUDPPort > 65535 || c.VideoGoCVUDPPort == 11111 {
+		errs = append(errs, "[video] gocv_udp_port must be a free port other than 11111, which gobot uses for the video")
+	}
+	if c.VideoJPEGQuality < 1 || c.VideoJPEGQuality > 100 {
+		errs = append(errs, "[video] jpeg_quality must be between 1 and 100")
 	}
+	return errs
 }
@@ -0,0 +1,208 @@
+// 録画したTelloのH.264(Annex-B)をデコーダー毎に流して、1フレームの遅延とCPU時間を比べる。
+// ドローンと同じように、フレームを-fpsの間隔で書き込み、書き込んでからデコードされるまでの時間を測る。
+// config.iniを読むので、gotelloのフォルダで実行する。
+//
+//	go run ./tools/decoderbench -file tello.h264 -decoders ffmpeg,gocv
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/roy1210/Study/Go-drone/gotello/app/models"
+	"github.com/roy1210/Study/Go-drone/gotello/config"
+)
+
+// VideoFrameEventと同じくらいの大きさで書き込む
+const packetSize = 1460
+
+var startCode = []byte{0, 0, 1}
+
+type result struct {
+	decoder      string
+	frames       int
+	errors       int
+	avgLatency   time.Duration
+	p95Latency   time.Duration
+	maxLatency   time.Duration
+	fps          float64
+	cpuPerFrame  time.Duration
+	totalCPUTime time.Duration
+}
+
+// 自分のプロセスと、終了した子プロセス(ffmpeg)のCPU時間
+func cpuTime() time.Duration {
+	var total time.Duration
+	for _, who := range []int{syscall.RUSAGE_SELF, syscall.RUSAGE_CHILDREN} {
+		var ru syscall.Rusage
+		if err := syscall.Getrusage(who, &ru); err != nil {
+			log.Fatalln(err)
+		}
+		total += time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+	}
+	return total
+}
+
+// ストリームをフレーム(アクセスユニット)毎に分ける。SPS, PPSは次のスライスと同じフレームに入れる。
+// 最初のSPSより前はデコードできないので捨てる
+func splitFrames(stream []byte) [][]byte {
+	var frames [][]byte
+	start := -1
+	for i := 0; i+3 < len(stream); i++ {
+		if !bytes.Equal(stream[i:i+3], startCode) {
+			continue
+		}
+		nalType := stream[i+3] & 0x1f
+		if start < 0 {
+			if nalType != 7 {
+				continue
+			}
+			start = i
+		}
+		// スライス(1: Pフレーム, 5: IDR)の次のNALから次のフレーム
+		if nalType != 1 && nalType != 5 {
+			continue
+		}
+		next := bytes.Index(stream[i+3:], startCode)
+		if next < 0 {
+			break
+		}
+		end := i + 3 + next
+		frames = append(frames, stream[start:end])
+		start = end
+		i = end - 1
+	}
+	return frames
+}
+
+// 書き込んだ時刻。i番目にデコードされたフレームはi番目に書き込んだフレーム
+type writeTimes struct {
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (w *writeTimes) add(t time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.times = append(w.times, t)
+}
+
+func (w *writeTimes) get(i int) (time.Time, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if i >= len(w.times) {
+		return time.Time{}, false
+	}
+	return w.times[i], true
+}
+
+func run(name string, frames [][]byte, count int, fps float64) result {
+	frame := models.NewFrameGeometry(config.Config.VideoWidth, config.Config.VideoHeight, config.Config.VideoPixFmt)
+	decoder, err := models.NewVideoDecoder(name, frame)
+	if err != nil {
+		log.Fatalf("decoder=%s err=%s", name, err.Error())
+	}
+	cpuStart := cpuTime()
+	if err := decoder.Start(); err != nil {
+		log.Fatalf("decoder=%s err=%s", name, err.Error())
+	}
+
+	// ファイルを繰り返し、1フレームずつ-fpsの間隔で流す
+	done := make(chan struct{})
+	written := &writeTimes{}
+	started := time.Now()
+	go func() {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / fps))
+		defer ticker.Stop()
+		for {
+			for _, f := range frames {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+				}
+				written.add(time.Now())
+				for i := 0; i < len(f); i += packetSize {
+					end := i + packetSize
+					if end > len(f) {
+						end = len(f)
+					}
+					decoder.Write(f[i:end])
+				}
+			}
+		}
+	}()
+
+	res := result{decoder: name}
+	buf := make([]byte, frame.Size)
+	var latencies []time.Duration
+	for res.frames < count && res.errors < 10 {
+		if err := decoder.ReadFrame(buf); err != nil {
+			res.errors++
+			continue
+		}
+		if at, ok := written.get(res.frames); ok {
+			latencies = append(latencies, time.Since(at))
+		}
+		res.frames++
+	}
+	elapsed := time.Since(started)
+	close(done)
+	// ffmpegは終了を待ってからでないとRUSAGE_CHILDRENに入らない
+	decoder.Close()
+
+	res.totalCPUTime = cpuTime() - cpuStart
+	if len(latencies) > 0 {
+		var total time.Duration
+		for _, l := range latencies {
+			total += l
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		res.avgLatency = total / time.Duration(len(latencies))
+		res.p95Latency = latencies[len(latencies)*95/100]
+		res.maxLatency = latencies[len(latencies)-1]
+	}
+	if res.frames > 0 {
+		res.fps = float64(res.frames) / elapsed.Seconds()
+		res.cpuPerFrame = res.totalCPUTime / time.Duration(res.frames)
+	}
+	return res
+}
+
+func main() {
+	file := flag.String("file", "", "recorded H.264 (Annex-B) stream from the Tello")
+	decoders := flag.String("decoders", "ffmpeg,gocv", "comma separated decoders to compare")
+	count := flag.Int("frames", 300, "frames to decode per decoder")
+	fps := flag.Float64("fps", 30, "frame rate of the recorded stream")
+	flag.Parse()
+
+	if *file == "" || *fps <= 0 {
+		flag.Usage()
+		return
+	}
+	stream, err := ioutil.ReadFile(*file)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	frames := splitFrames(stream)
+	if len(frames) == 0 {
+		log.Fatalln("no SPS and slices found, the file must be an Annex-B H.264 stream")
+	}
+
+	fmt.Printf("%-8s %7s %7s %12s %12s %12s %8s %12s %12s\n",
+		"decoder", "frames", "errors", "latency avg", "p95", "max", "fps", "cpu/frame", "cpu")
+	for _, name := range strings.Split(*decoders, ",") {
+		r := run(strings.TrimSpace(name), frames, *count, *fps)
+		fmt.Printf("%-8s %7d %7d %12s %12s %12s %8.1f %12s %12s\n",
+			r.decoder, r.frames, r.errors, r.avgLatency, r.p95Latency, r.maxLatency,
+			r.fps, r.cpuPerFrame, r.totalCPUTime)
+	}
+}
@@ -0,0 +1,48 @@
+// config.iniの[users]と[tokens]に書く値を作る。
+//
+//	go run ./tools/hashpassword          # パスワードを入力して、bcryptのhashを出す
+//	go run ./tools/hashpassword -token   # ランダムなtokenと、そのsha256を出す
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func main() {
+	token := flag.Bool("token", false, "generate an API token instead of hashing a password")
+	role := flag.String("role", "pilot", "viewer, pilot or admin")
+	flag.Parse()
+
+	if *token {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			log.Fatal(err)
+		}
+		t := hex.EncodeToString(buf)
+		sum := sha256.Sum256([]byte(t))
+		fmt.Printf("token (give to the client): %s\n", t)
+		fmt.Printf("config.ini [tokens]: <name> = %s:%s\n", *role, hex.EncodeToString(sum[:]))
+		return
+	}
+
+	fmt.Fprint(os.Stderr, "password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		log.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(strings.TrimRight(password, "\r\n")), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("config.ini [users]: <name> = %s:%s\n", *role, hash)
+}